@@ -1,62 +1,148 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/badgerodon/socketmaster/protocol"
 	"github.com/hashicorp/yamux"
 )
 
+// DefaultSocketMasterAddress is the address used by the package level Listen.
+// Unix sockets can be used with a "unix:///run/socketmaster.sock" style
+// address.
 var DefaultSocketMasterAddress = "127.0.0.1:9999"
 
 type Client struct {
 	socketMasterAddress string
+	// Token is sent to the socket master to authenticate the client
+	Token string
+	// Dialer is used to connect to the socket master. If nil a zero Dialer is
+	// used.
+	Dialer *net.Dialer
+	// HandshakeTimeout limits how long registering a socket may take. Zero
+	// means no timeout.
+	HandshakeTimeout time.Duration
 }
 
 func New(socketMasterAddress string) *Client {
-	return &Client{socketMasterAddress}
+	return &Client{socketMasterAddress: socketMasterAddress}
 }
 
 // Listen connects to the socket master, binds a port, and accepts
-// multiplexed traffic as new connections
-func (client *Client) Listen(socketDefinition protocol.SocketDefinition) (net.Listener, error) {
-	// connect to the socket master
-	conn, err := net.Dial("tcp", client.socketMasterAddress)
+// multiplexed traffic as new connections. If the connection to the socket
+// master is lost the listener reconnects and registers the socket again.
+func (client *Client) Listen(socketDefinition protocol.SocketDefinition) (*Listener, error) {
+	return client.ListenContext(context.Background(), socketDefinition)
+}
+
+// ListenContext is like Listen but uses ctx to connect to the socket master.
+// Once ctx is done the listener is closed and Accept returns ctx.Err().
+func (client *Client) ListenContext(ctx context.Context, socketDefinition protocol.SocketDefinition) (*Listener, error) {
+	session, res, err := client.dial(ctx, socketDefinition)
 	if err != nil {
 		return nil, err
 	}
 
-	// bind to a port
-	err = protocol.WriteHandshakeRequest(conn, protocol.HandshakeRequest{
-		SocketDefinition: socketDefinition,
+	// keep the port the socket master bound so reconnecting (even to a
+	// restarted socket master) doesn't change the listener's address
+	if socketDefinition.Port == 0 {
+		socketDefinition.Port = res.Port
+	}
+
+	li := &Listener{
+		client:           client,
+		ctx:              ctx,
+		socketDefinition: socketDefinition,
+		session:          session,
+		res:              res,
+		closed:           make(chan struct{}),
+	}
+	li.stop = context.AfterFunc(ctx, func() {
+		li.close(ctx.Err())
 	})
-	if err != nil {
-		conn.Close()
-		return nil, err
+	return li, nil
+}
+
+// dial connects to the socket master and registers the socket
+func (client *Client) dial(ctx context.Context, socketDefinition protocol.SocketDefinition) (*yamux.Session, protocol.HandshakeResponse, error) {
+	dialer := client.Dialer
+	if dialer == nil {
+		dialer = new(net.Dialer)
 	}
 
-	// see if that worked
-	res, err := protocol.ReadHandshakeResponse(conn)
+	// connect to the socket master
+	network, address := protocol.ParseAddress(client.socketMasterAddress)
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return nil, protocol.HandshakeResponse{}, err
+	}
+
+	// the handshake is bounded by the timeout and by the context
+	if client.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(client.HandshakeTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	res, err := client.handshake(conn, socketDefinition)
+	if !stop() || (err != nil && ctx.Err() != nil) {
+		err = ctx.Err()
 	}
-	if res.Status != "OK" {
+	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("%s", res.Status)
+		return nil, res, err
 	}
+	conn.SetDeadline(time.Time{})
 
 	// start a new session
 	session, err := yamux.Server(conn, yamux.DefaultConfig())
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, res, err
 	}
 
-	return session, nil
+	return session, res, nil
 }
 
-func Listen(socketDefinition protocol.SocketDefinition) (net.Listener, error) {
+// handshake registers the socket over an established connection
+func (client *Client) handshake(conn net.Conn, socketDefinition protocol.SocketDefinition) (protocol.HandshakeResponse, error) {
+	// bind to a port
+	err := protocol.WriteHandshakeRequest(conn, protocol.HandshakeRequest{
+		Version:          protocol.Version,
+		Capabilities:     protocol.SupportedCapabilities,
+		SocketDefinition: socketDefinition,
+		Token:            client.Token,
+	})
+	if err != nil {
+		return protocol.HandshakeResponse{}, err
+	}
+
+	// see if that worked
+	res, err := protocol.ReadHandshakeResponse(conn)
+	if err != nil {
+		return res, err
+	}
+	err = res.Err()
+	if err != nil {
+		return res, err
+	}
+	if res.Version < 1 || res.Version > protocol.Version {
+		return res, &protocol.HandshakeError{
+			Code:    protocol.CodeUnsupportedVersion,
+			Message: fmt.Sprintf("server replied with version %d", res.Version),
+		}
+	}
+
+	return res, nil
+}
+
+func Listen(socketDefinition protocol.SocketDefinition) (*Listener, error) {
 	return New(DefaultSocketMasterAddress).Listen(socketDefinition)
 }
+
+func ListenContext(ctx context.Context, socketDefinition protocol.SocketDefinition) (*Listener, error) {
+	return New(DefaultSocketMasterAddress).ListenContext(ctx, socketDefinition)
+}
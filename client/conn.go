@@ -0,0 +1,58 @@
+package client
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+// A Conn is a connection accepted by a Listener. It's multiplexed over the
+// connection to the socket master but reports the address of the client that
+// connected to the socket master.
+type Conn struct {
+	net.Conn
+	metadata protocol.StreamMetadata
+}
+
+// RemoteAddr returns the address of the upstream client. If the socket
+// master didn't send one the address of the stream is returned instead.
+func (conn *Conn) RemoteAddr() net.Addr {
+	if conn.metadata.RemoteIP == "" {
+		return conn.Conn.RemoteAddr()
+	}
+	return &net.TCPAddr{
+		IP:   net.ParseIP(conn.metadata.RemoteIP),
+		Port: conn.metadata.RemotePort,
+	}
+}
+
+// LocalAddr returns the upstream address the client connected to
+func (conn *Conn) LocalAddr() net.Addr {
+	if conn.metadata.LocalIP == "" {
+		return conn.Conn.LocalAddr()
+	}
+	return &net.TCPAddr{
+		IP:   net.ParseIP(conn.metadata.LocalIP),
+		Port: conn.metadata.LocalPort,
+	}
+}
+
+// Metadata returns what the socket master knows about the upstream
+// connection, such as the TLS server name requested by the client. Streams
+// to HTTP sockets are shared, so use RequestMetadata for those.
+func (conn *Conn) Metadata() protocol.StreamMetadata {
+	return conn.metadata
+}
+
+// RequestMetadata returns what the socket master knows about the client that
+// sent an HTTP request. Streams to HTTP sockets are shared by clients, so
+// this is used instead of the Conn's Metadata.
+func RequestMetadata(req *http.Request) (protocol.StreamMetadata, bool) {
+	v := req.Header.Get(protocol.MetadataHeader)
+	if v == "" {
+		return protocol.StreamMetadata{}, false
+	}
+	md, err := protocol.DecodeStreamMetadata(v)
+	return md, err == nil
+}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -10,86 +12,222 @@ import (
 	"github.com/hashicorp/yamux"
 )
 
+// ErrClosed is returned by Accept once the listener has been closed
+var ErrClosed = errors.New("listener closed")
+
+// A Listener accepts connections routed to it by the socket master. It
+// survives socket master restarts by reconnecting and registering its socket
+// again, so Accept only fails once the listener is closed or the socket
+// master permanently rejects the registration.
 type Listener struct {
-	socketMasterAddress string
-	socketDefinition    protocol.SocketDefinition
-	session             *yamux.Session
-	mu                  sync.Mutex
+	client           *Client
+	ctx              context.Context
+	socketDefinition protocol.SocketDefinition
+	// stop unregisters the context callback that closes the listener
+	stop func() bool
+
+	// dialMu ensures only one goroutine reconnects at a time
+	dialMu sync.Mutex
+
+	mu      sync.Mutex
+	session *yamux.Session
+	// res is the handshake response for the current (or last) session
+	res    protocol.HandshakeResponse
+	err    error
+	closed chan struct{}
 }
 
-func (li *Listener) getSession() (*yamux.Session, error) {
-	li.mu.Lock()
-	defer li.mu.Unlock()
+func (li *Listener) getSession() (*yamux.Session, protocol.HandshakeResponse, error) {
+	li.dialMu.Lock()
+	defer li.dialMu.Unlock()
 
-	if li.session != nil {
-		return li.session, nil
-	}
+	var delay time.Duration // how long to wait before reconnecting
+	for {
+		li.mu.Lock()
+		session, res, err := li.session, li.res, li.err
+		socketDefinition := li.socketDefinition
+		li.mu.Unlock()
+		if err != nil {
+			return nil, res, err
+		}
+		if session != nil {
+			return session, res, nil
+		}
 
-	// connect to the socket master
-	conn, err := net.Dial("tcp", li.socketMasterAddress)
-	if err != nil {
-		return nil, err
-	}
+		session, res, err = li.client.dial(li.ctx, socketDefinition)
 
-	// bind to a port
-	err = protocol.WriteHandshakeRequest(conn, protocol.HandshakeRequest{
-		SocketDefinition: li.socketDefinition,
-	})
-	if err != nil {
-		conn.Close()
-		return nil, err
-	}
+		li.mu.Lock()
+		switch {
+		case li.err != nil:
+			// closed while we were dialing
+			if session != nil {
+				session.Close()
+			}
+		case err == nil:
+			li.session = session
+			li.res = res
+		case isPermanent(err):
+			li.err = err
+		}
+		li.mu.Unlock()
+		if err == nil || isPermanent(err) {
+			continue
+		}
 
-	// see if that worked
-	res, err := protocol.ReadHandshakeResponse(conn)
-	if err != nil {
-		conn.Close()
-		return nil, err
-	}
-	if res.Status != "OK" {
-		conn.Close()
-		return nil, fmt.Errorf("%s", res.Status)
+		if delay == 0 {
+			delay = 100 * time.Millisecond
+		} else {
+			delay *= 2
+		}
+		if max := 5 * time.Second; delay > max {
+			delay = max
+		}
+		select {
+		case <-li.closed:
+		case <-time.After(delay):
+		}
 	}
+}
 
-	// start a new session
-	session, err := yamux.Server(conn, yamux.DefaultConfig())
-	if err != nil {
-		conn.Close()
-		return nil, err
+// resetSession discards a broken session so the next call to getSession
+// reconnects
+func (li *Listener) resetSession(session *yamux.Session) {
+	li.mu.Lock()
+	if li.session == session {
+		li.session = nil
 	}
-
-	return session, nil
+	li.mu.Unlock()
+	session.Close()
 }
 
 func (li *Listener) Accept() (net.Conn, error) {
-	deadline := time.Now().Add(time.Second * 30)
-	for time.Now().Before(deadline) {
-		session, err := li.getSession()
+	for {
+		session, res, err := li.getSession()
 		if err != nil {
-			time.Sleep(time.Second * 1)
-			continue
+			return nil, err
 		}
 
-		conn, err := session.Accept()
+		stream, err := session.Accept()
 		if err != nil {
-			li.mu.Lock()
-			li.session = nil
-			li.mu.Unlock()
-			session.Close()
-			time.Sleep(time.Second * 1)
+			li.resetSession(session)
 			continue
 		}
-		if err == nil {
-			return conn, nil
+
+		conn := &Conn{Conn: stream}
+		if res.Capabilities&protocol.CapabilityStreamMetadata != 0 {
+			conn.metadata, err = protocol.ReadStreamMetadata(stream)
+			if err != nil {
+				stream.Close()
+				continue
+			}
+			// answering health checks shows we're still accepting connections
+			if conn.metadata.HealthCheck {
+				stream.Write([]byte{1})
+				stream.Close()
+				continue
+			}
 		}
+		return conn, nil
 	}
-	return nil, fmt.Errorf("failed to get connection")
 }
 
 func (li *Listener) Close() error {
-	panic("not implemented")
+	li.stop()
+	li.close(ErrClosed)
+	return nil
+}
+
+// close shuts the listener down, making Accept return err
+func (li *Listener) close(err error) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	select {
+	case <-li.closed:
+		return
+	default:
+	}
+	li.err = err
+	close(li.closed)
+	if li.session != nil {
+		li.session.Close()
+		li.session = nil
+	}
+}
+
+// SetWeight changes the listener's balancing weight without registering
+// again. A weight of 0 stops the listener's traffic. The new weight is also
+// used if the listener has to reconnect. Routes whose balancing strategy
+// ignores weights reject the change with protocol.ErrInvalidDefinition.
+func (li *Listener) SetWeight(weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("invalid weight: %d", weight)
+	}
+
+	session, res, err := li.getSession()
+	if err != nil {
+		return err
+	}
+	if res.Capabilities&protocol.CapabilityControl == 0 {
+		return fmt.Errorf("socket master can't change weights: %w", errors.ErrUnsupported)
+	}
+
+	stream, err := session.Open()
+	if err != nil {
+		li.resetSession(session)
+		return err
+	}
+	defer stream.Close()
+	if li.client.HandshakeTimeout > 0 {
+		stream.SetDeadline(time.Now().Add(li.client.HandshakeTimeout))
+	}
+
+	err = protocol.WriteControlRequest(stream, protocol.ControlRequest{
+		ChangeWeight: true,
+		Weight:       weight,
+	})
+	if err != nil {
+		return err
+	}
+	cres, err := protocol.ReadControlResponse(stream)
+	if err != nil {
+		return err
+	}
+	err = cres.Err()
+	if err != nil {
+		return err
+	}
+
+	li.mu.Lock()
+	var balance protocol.SocketBalanceDefinition
+	if li.socketDefinition.Balance != nil {
+		balance = *li.socketDefinition.Balance
+	}
+	balance.Weight = &weight
+	li.socketDefinition.Balance = &balance
+	li.mu.Unlock()
+	return nil
 }
 
+// Addr returns the upstream address the socket master is listening on for
+// this listener. If port 0 was requested this includes the port the socket
+// master chose.
 func (li *Listener) Addr() net.Addr {
-	panic("not implemented")
+	li.mu.Lock()
+	res := li.res
+	li.mu.Unlock()
+
+	return &net.TCPAddr{
+		IP:   net.ParseIP(res.Address),
+		Port: res.Port,
+	}
+}
+
+// isPermanent returns true if retrying the registration can't succeed
+func isPermanent(err error) bool {
+	return errors.Is(err, protocol.ErrPermissionDenied) ||
+		errors.Is(err, protocol.ErrInvalidCert) ||
+		errors.Is(err, protocol.ErrConflictingRoute) ||
+		errors.Is(err, protocol.ErrUnsupportedVersion) ||
+		errors.Is(err, protocol.ErrInvalidDefinition)
 }
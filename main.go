@@ -4,19 +4,26 @@ import (
 	"flag"
 	"log"
 	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
 
+	"github.com/badgerodon/socketmaster/protocol"
 	"github.com/badgerodon/socketmaster/server"
 )
 
 var (
-	bind = flag.String("bind", "127.0.0.1:9999", "address to accept downstream connections")
+	bind        = flag.String("bind", "127.0.0.1:9999", "address to accept downstream connections (use unix:///path/to/socket for a unix socket)")
+	socketMode  = flag.String("socket-mode", "0660", "file mode for a unix socket")
+	socketGroup = flag.String("socket-group", "", "group to own a unix socket")
 )
 
 func main() {
 	log.SetFlags(0)
 	flag.Parse()
 	log.Println("[socketmaster] starting server on", *bind)
-	li, err := net.Listen("tcp", *bind)
+	li, err := listen(*bind)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -26,3 +33,58 @@ func main() {
 	defer s.Close()
 	s.Serve()
 }
+
+func listen(addr string) (net.Listener, error) {
+	network, address := protocol.ParseAddress(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	// remove a stale socket left behind by a previous run
+	if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(address)
+	}
+
+	// the socket is created in a directory only we can access and moved into
+	// place once its permissions are set, so nobody else can connect to it in
+	// between
+	dir, err := os.MkdirTemp(filepath.Dir(address), ".socketmaster-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+
+	li, err := net.Listen(network, tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the socket won't be at tmp anymore
+	li.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	// only processes with access to the socket file may register sockets
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err == nil {
+		err = os.Chmod(tmp, os.FileMode(mode))
+	}
+	if err == nil && *socketGroup != "" {
+		var g *user.Group
+		g, err = user.LookupGroup(*socketGroup)
+		if err == nil {
+			var gid int
+			gid, err = strconv.Atoi(g.Gid)
+			if err == nil {
+				err = os.Chown(tmp, -1, gid)
+			}
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, address)
+	}
+	if err != nil {
+		li.Close()
+		return nil, err
+	}
+
+	return li, nil
+}
@@ -0,0 +1,17 @@
+package protocol
+
+import "strings"
+
+// ParseAddress splits a socket master address into the network and address
+// to pass to net.Dial or net.Listen. Addresses may be given as
+// "unix:///run/socketmaster.sock", "tcp://127.0.0.1:9999" or just
+// "127.0.0.1:9999".
+func ParseAddress(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", strings.TrimPrefix(addr, "tcp://")
+	}
+	return "tcp", addr
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// HMACToken creates a token for identity signed with secret. The server
+// verifies it with the same secret and uses the identity to look up what the
+// client is allowed to bind.
+func HMACToken(secret []byte, identity string) string {
+	return identity + ":" + hex.EncodeToString(hmacSum(secret, identity))
+}
+
+// ParseHMACToken verifies a token created by HMACToken and returns the
+// identity it was created for
+func ParseHMACToken(secret []byte, token string) (identity string, ok bool) {
+	idx := strings.LastIndexByte(token, ':')
+	if idx < 0 {
+		return "", false
+	}
+	identity = token[:idx]
+	sum, err := hex.DecodeString(token[idx+1:])
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(sum, hmacSum(secret, identity)) {
+		return "", false
+	}
+	return identity, true
+}
+
+func hmacSum(secret []byte, identity string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(identity))
+	return h.Sum(nil)
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An ErrorCode describes why a handshake failed
+type ErrorCode int
+
+const (
+	CodeOK ErrorCode = iota
+	CodeUnknown
+	CodePortInUse
+	CodePermissionDenied
+	CodeInvalidCert
+	CodeConflictingRoute
+	CodeUnsupportedVersion
+	CodeInvalidDefinition
+)
+
+var (
+	ErrUnknown            = errors.New("unknown error")
+	ErrPortInUse          = errors.New("port in use")
+	ErrPermissionDenied   = errors.New("permission denied")
+	ErrInvalidCert        = errors.New("invalid certificate")
+	ErrConflictingRoute   = errors.New("conflicting route")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrInvalidDefinition  = errors.New("invalid socket definition")
+)
+
+var codeErrors = map[ErrorCode]error{
+	CodeUnknown:            ErrUnknown,
+	CodePortInUse:          ErrPortInUse,
+	CodePermissionDenied:   ErrPermissionDenied,
+	CodeInvalidCert:        ErrInvalidCert,
+	CodeConflictingRoute:   ErrConflictingRoute,
+	CodeUnsupportedVersion: ErrUnsupportedVersion,
+	CodeInvalidDefinition:  ErrInvalidDefinition,
+}
+
+// A HandshakeError is returned when the server rejects a handshake. It
+// matches the sentinel error for its code with errors.Is:
+//
+//	if errors.Is(err, protocol.ErrPortInUse) { ... }
+type HandshakeError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *HandshakeError) Error() string {
+	if err.Message == "" {
+		return err.Code.String()
+	}
+	return fmt.Sprintf("%s: %s", err.Code, err.Message)
+}
+
+func (err *HandshakeError) Is(target error) bool {
+	sentinel, ok := codeErrors[err.Code]
+	return ok && sentinel == target
+}
+
+func (code ErrorCode) String() string {
+	if code == CodeOK {
+		return "OK"
+	}
+	if err, ok := codeErrors[code]; ok {
+		return err.Error()
+	}
+	return fmt.Sprintf("error code %d", int(code))
+}
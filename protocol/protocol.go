@@ -2,31 +2,60 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"strings"
+	"time"
 )
 
+// limits on what Read accepts so a peer can't make it allocate arbitrary
+// amounts of memory. maxSize is the length of strings and byte slices and
+// maxEntries the number of entries in lists and maps.
+const (
+	maxSize    = 1 << 20
+	maxEntries = 1 << 12
+)
+
+// readSize reads a length and checks that it's between 0 and max
+func readSize(r io.Reader, max int) (int, error) {
+	var sz int
+	err := Read(r, &sz)
+	if err != nil {
+		return 0, err
+	}
+	if sz < 0 || sz > max {
+		return 0, fmt.Errorf("invalid size: %d", sz)
+	}
+	return sz, nil
+}
+
 func Read(r io.Reader, dsts ...interface{}) error {
 	var err error
 	for _, dst := range dsts {
 		switch t := dst.(type) {
 		case *int:
 			data := make([]byte, 8)
-			_, err = r.Read(data)
+			_, err = io.ReadFull(r, data)
 			if err == nil {
 				*t = int(binary.BigEndian.Uint64(data))
 			}
 		case *byte:
 			data := make([]byte, 1)
-			_, err = r.Read(data)
+			_, err = io.ReadFull(r, data)
 			if err == nil {
 				*t = data[0]
 			}
+		case *bool:
+			var b byte
+			err = Read(r, &b)
+			if err == nil {
+				*t = b != 0
+			}
 		case *[]byte:
 			var sz int
-			err = Read(r, &sz)
+			sz, err = readSize(r, maxSize)
 			if err == nil {
 				buf := bytes.NewBuffer(make([]byte, 0, sz))
 				n, err := io.CopyN(buf, r, int64(sz))
@@ -40,7 +69,7 @@ func Read(r io.Reader, dsts ...interface{}) error {
 			}
 		case *string:
 			var sz int
-			err = Read(r, &sz)
+			sz, err = readSize(r, maxSize)
 			if err == nil {
 				buf := bytes.NewBuffer(make([]byte, 0, sz))
 				n, err := io.CopyN(buf, r, int64(sz))
@@ -54,7 +83,7 @@ func Read(r io.Reader, dsts ...interface{}) error {
 			}
 		case *map[string]string:
 			var sz int
-			err = Read(r, &sz)
+			sz, err = readSize(r, maxEntries)
 			if err == nil {
 				m := make(map[string]string, sz)
 				for i := 0; i < sz; i++ {
@@ -67,6 +96,25 @@ func Read(r io.Reader, dsts ...interface{}) error {
 				}
 				*t = m
 			}
+		case *time.Duration:
+			var n int
+			err = Read(r, &n)
+			if err == nil {
+				*t = time.Duration(n)
+			}
+		case *[]string:
+			var sz int
+			sz, err = readSize(r, maxEntries)
+			if err == nil {
+				ss := make([]string, sz)
+				for i := range ss {
+					err = Read(r, &ss[i])
+					if err != nil {
+						return err
+					}
+				}
+				*t = ss
+			}
 		case *SocketDefinition:
 			var flags byte
 			err = Read(r, &t.Address, &t.Port, &flags)
@@ -101,6 +149,12 @@ func Write(w io.Writer, args ...interface{}) error {
 		case byte:
 			data := []byte{t}
 			_, err = w.Write(data)
+		case bool:
+			var b byte
+			if t {
+				b = 1
+			}
+			err = Write(w, b)
 		case int:
 			data := make([]byte, 8)
 			binary.BigEndian.PutUint64(data, uint64(t))
@@ -125,6 +179,18 @@ func Write(w io.Writer, args ...interface{}) error {
 					}
 				}
 			}
+		case time.Duration:
+			err = Write(w, int(t))
+		case []string:
+			err = Write(w, len(t))
+			if err == nil {
+				for _, s := range t {
+					err = Write(w, s)
+					if err != nil {
+						return err
+					}
+				}
+			}
 		case SocketDefinition:
 			var flags byte = 0
 			if t.HTTP != nil {
@@ -151,22 +217,389 @@ func Write(w io.Writer, args ...interface{}) error {
 	return err
 }
 
+// readMagic reads the start of a handshake and reports whether it begins
+// with Magic. If it doesn't, the returned reader replays the consumed bytes so
+// the legacy (version 0) format can be decoded from it.
+func readMagic(r io.Reader) (io.Reader, bool, error) {
+	data := make([]byte, len(Magic))
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return r, false, err
+	}
+	if string(data) == Magic {
+		return r, true, nil
+	}
+	return io.MultiReader(bytes.NewReader(data), r), false, nil
+}
+
+// readFields reads the tagged fields that follow a versioned handshake,
+// calling fn for each of them. Fields are length-prefixed so fn can simply
+// ignore tags it doesn't know about.
+func readFields(r io.Reader, fn func(tag byte, r io.Reader) error) error {
+	for {
+		var tag byte
+		err := Read(r, &tag)
+		if err != nil {
+			return err
+		}
+		if tag == fieldEnd {
+			return nil
+		}
+		var data []byte
+		err = Read(r, &data)
+		if err != nil {
+			return err
+		}
+		err = fn(tag, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeFields writes tagged fields followed by the end marker
+func writeFields(w io.Writer, fields ...field) error {
+	for _, f := range fields {
+		var buf bytes.Buffer
+		err := Write(&buf, f.args...)
+		if err != nil {
+			return err
+		}
+		err = Write(w, f.tag, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return Write(w, fieldEnd)
+}
+
+// ReadHandshakeRequest reads a handshake request. Both versioned requests and
+// legacy requests (which consist of nothing but the socket definition) are
+// understood. Legacy requests are reported as Version 0.
 func ReadHandshakeRequest(r io.Reader) (HandshakeRequest, error) {
 	var req HandshakeRequest
-	err := Read(r, &req.SocketDefinition)
+	r, versioned, err := readMagic(r)
+	if err != nil {
+		return req, err
+	}
+	if !versioned {
+		err = Read(r, &req.SocketDefinition)
+		return req, err
+	}
+
+	err = Read(r, &req.Version, (*int)(&req.Capabilities), &req.SocketDefinition)
+	if err != nil {
+		return req, err
+	}
+	err = readFields(r, func(tag byte, r io.Reader) error {
+		switch tag {
+		case fieldToken:
+			return Read(r, &req.Token)
+		case fieldProxyProtocol:
+			pp := new(SocketProxyProtocolDefinition)
+			req.SocketDefinition.ProxyProtocol = pp
+			return Read(r, &pp.Accept, &pp.Send)
+		case fieldBalance:
+			b := req.SocketDefinition.Balance
+			if b == nil {
+				b = new(SocketBalanceDefinition)
+				req.SocketDefinition.Balance = b
+			}
+			// a negative weight means it's unset
+			var weight int
+			err := Read(r, &b.Strategy, &weight)
+			if err == nil && weight >= 0 {
+				b.Weight = &weight
+			}
+			return err
+		case fieldBalanceHash:
+			b := req.SocketDefinition.Balance
+			if b == nil {
+				b = new(SocketBalanceDefinition)
+				req.SocketDefinition.Balance = b
+			}
+			return Read(r, &b.HashCookie, &b.HashHeader)
+		case fieldHTTPMatch:
+			h := req.SocketDefinition.HTTP
+			if h == nil {
+				return fmt.Errorf("HTTP match without an HTTP definition")
+			}
+			return Read(r, &h.Host, &h.Methods, &h.Headers, &h.Query, &h.PathRegex)
+		case fieldHTTPRewrite:
+			h := req.SocketDefinition.HTTP
+			if h == nil {
+				return fmt.Errorf("HTTP rewrite without an HTTP definition")
+			}
+			rw := new(SocketHTTPRewriteDefinition)
+			h.Rewrite = rw
+			return Read(r, &rw.StripPrefix, &rw.AddPrefix, &rw.PathRegex, &rw.PathReplacement, &rw.Host,
+				&rw.RequestHeaders, &rw.RemoveRequestHeaders, &rw.ResponseHeaders, &rw.RemoveResponseHeaders)
+		case fieldHTTPErrorPage:
+			h := req.SocketDefinition.HTTP
+			if h == nil {
+				return fmt.Errorf("HTTP error page without an HTTP definition")
+			}
+			var page SocketHTTPErrorPage
+			err := Read(r, &page.Status, &page.ContentType, &page.Template)
+			h.ErrorPages = append(h.ErrorPages, page)
+			return err
+		case fieldHealthCheck:
+			hc := new(SocketHealthCheckDefinition)
+			req.SocketDefinition.HealthCheck = hc
+			return Read(r, &hc.Type, &hc.Path, &hc.ExpectedStatus, &hc.Interval, &hc.Timeout,
+				&hc.UnhealthyThreshold, &hc.HealthyThreshold)
+		case fieldTLSClientCert:
+			tls := req.SocketDefinition.TLS
+			if tls == nil {
+				return fmt.Errorf("TLS client certificate request without a TLS definition")
+			}
+			tls.RequestClientCert = true
+			return nil
+		case fieldMissingRouteTimeout:
+			return Read(r, &req.SocketDefinition.MissingRouteTimeout)
+		}
+		return nil
+	})
 	return req, err
 }
 
+// WriteHandshakeRequest writes a handshake request. A request with Version 0
+// is written in the legacy format.
 func WriteHandshakeRequest(w io.Writer, req HandshakeRequest) error {
-	return Write(w, req.SocketDefinition)
+	if req.Version == 0 {
+		return Write(w, req.SocketDefinition)
+	}
+
+	_, err := io.WriteString(w, Magic)
+	if err != nil {
+		return err
+	}
+	err = Write(w, req.Version, int(req.Capabilities), req.SocketDefinition)
+	if err != nil {
+		return err
+	}
+	var fields []field
+	if req.Token != "" {
+		fields = append(fields, field{fieldToken, []interface{}{req.Token}})
+	}
+	if pp := req.SocketDefinition.ProxyProtocol; pp != nil {
+		fields = append(fields, field{fieldProxyProtocol, []interface{}{pp.Accept, pp.Send}})
+	}
+	if h := req.SocketDefinition.HTTP; h != nil &&
+		(h.Host != "" || len(h.Methods) > 0 || len(h.Headers) > 0 || len(h.Query) > 0 || h.PathRegex != "") {
+		fields = append(fields, field{fieldHTTPMatch, []interface{}{
+			h.Host, h.Methods, h.Headers, h.Query, h.PathRegex,
+		}})
+	}
+	if h := req.SocketDefinition.HTTP; h != nil && h.Rewrite != nil {
+		rw := h.Rewrite
+		fields = append(fields, field{fieldHTTPRewrite, []interface{}{
+			rw.StripPrefix, rw.AddPrefix, rw.PathRegex, rw.PathReplacement, rw.Host,
+			rw.RequestHeaders, rw.RemoveRequestHeaders, rw.ResponseHeaders, rw.RemoveResponseHeaders,
+		}})
+	}
+	if h := req.SocketDefinition.HTTP; h != nil {
+		for _, page := range h.ErrorPages {
+			fields = append(fields, field{fieldHTTPErrorPage, []interface{}{
+				page.Status, page.ContentType, page.Template,
+			}})
+		}
+	}
+	if hc := req.SocketDefinition.HealthCheck; hc != nil {
+		fields = append(fields, field{fieldHealthCheck, []interface{}{
+			hc.Type, hc.Path, hc.ExpectedStatus, hc.Interval, hc.Timeout,
+			hc.UnhealthyThreshold, hc.HealthyThreshold,
+		}})
+	}
+	if tls := req.SocketDefinition.TLS; tls != nil && tls.RequestClientCert {
+		fields = append(fields, field{fieldTLSClientCert, nil})
+	}
+	if t := req.SocketDefinition.MissingRouteTimeout; t != 0 {
+		fields = append(fields, field{fieldMissingRouteTimeout, []interface{}{t}})
+	}
+	if b := req.SocketDefinition.Balance; b != nil {
+		weight := -1
+		if b.Weight != nil {
+			weight = *b.Weight
+		}
+		fields = append(fields, field{fieldBalance, []interface{}{b.Strategy, weight}})
+		if b.HashCookie != "" || b.HashHeader != "" {
+			fields = append(fields, field{fieldBalanceHash, []interface{}{b.HashCookie, b.HashHeader}})
+		}
+	}
+	return writeFields(w, fields...)
 }
 
+// ReadHandshakeResponse reads a handshake response in either the versioned or
+// the legacy format
 func ReadHandshakeResponse(r io.Reader) (HandshakeResponse, error) {
 	var res HandshakeResponse
-	err := Read(r, &res.Status)
+	r, versioned, err := readMagic(r)
+	if err != nil {
+		return res, err
+	}
+	if !versioned {
+		err = Read(r, &res.Status)
+		if err == nil && res.Status != "OK" {
+			res.Code = CodeUnknown
+			res.Message = res.Status
+		}
+		return res, err
+	}
+
+	err = Read(r, &res.Version, (*int)(&res.Capabilities), &res.Status)
+	if err != nil {
+		return res, err
+	}
+	err = readFields(r, func(tag byte, r io.Reader) error {
+		switch tag {
+		case fieldResult:
+			return Read(r, (*int)(&res.Code), &res.Message)
+		case fieldListener:
+			return Read(r, &res.Address, &res.Port)
+		}
+		return nil
+	})
 	return res, err
 }
 
+// WriteHandshakeResponse writes a handshake response. A response with Version
+// 0 is written in the legacy format.
 func WriteHandshakeResponse(w io.Writer, res HandshakeResponse) error {
-	return Write(w, res.Status)
+	if res.Version == 0 {
+		return Write(w, res.Status)
+	}
+
+	_, err := io.WriteString(w, Magic)
+	if err != nil {
+		return err
+	}
+	err = Write(w, res.Version, int(res.Capabilities), res.Status)
+	if err != nil {
+		return err
+	}
+	return writeFields(w,
+		field{fieldResult, []interface{}{int(res.Code), res.Message}},
+		field{fieldListener, []interface{}{res.Address, res.Port}},
+	)
+}
+
+// Err returns the error described by the response, or nil if the handshake
+// succeeded
+func (res HandshakeResponse) Err() error {
+	if res.Code != CodeOK {
+		return &HandshakeError{Code: res.Code, Message: res.Message}
+	}
+	if res.Status != "OK" {
+		return &HandshakeError{Code: CodeUnknown, Message: res.Status}
+	}
+	return nil
+}
+
+// ReadStreamMetadata reads the metadata at the start of a stream
+func ReadStreamMetadata(r io.Reader) (StreamMetadata, error) {
+	var md StreamMetadata
+	err := readFields(r, func(tag byte, r io.Reader) error {
+		switch tag {
+		case fieldRemoteAddress:
+			return Read(r, &md.RemoteIP, &md.RemotePort)
+		case fieldLocalAddress:
+			return Read(r, &md.LocalIP, &md.LocalPort)
+		case fieldTLS:
+			md.TLS = new(StreamTLSMetadata)
+			return Read(r, &md.TLS.ServerName, &md.TLS.NegotiatedProtocol, &md.TLS.ClientCertSubject)
+		case fieldHealthCheck:
+			md.HealthCheck = true
+		}
+		return nil
+	})
+	return md, err
+}
+
+// WriteStreamMetadata writes the metadata at the start of a stream
+func WriteStreamMetadata(w io.Writer, md StreamMetadata) error {
+	fields := []field{
+		{fieldRemoteAddress, []interface{}{md.RemoteIP, md.RemotePort}},
+		{fieldLocalAddress, []interface{}{md.LocalIP, md.LocalPort}},
+	}
+	if md.TLS != nil {
+		fields = append(fields, field{fieldTLS, []interface{}{
+			md.TLS.ServerName, md.TLS.NegotiatedProtocol, md.TLS.ClientCertSubject,
+		}})
+	}
+	if md.HealthCheck {
+		fields = append(fields, field{fieldHealthCheck, nil})
+	}
+	return writeFields(w, fields...)
+}
+
+// MetadataHeader carries the StreamMetadata of the client that sent a request
+// to an HTTP socket. Streams to HTTP sockets are shared by clients, so their
+// own metadata doesn't describe any of them.
+const MetadataHeader = "Socketmaster-Metadata"
+
+// EncodeStreamMetadata encodes metadata for the MetadataHeader
+func EncodeStreamMetadata(md StreamMetadata) string {
+	var buf bytes.Buffer
+	WriteStreamMetadata(&buf, md)
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// DecodeStreamMetadata decodes the value of a MetadataHeader
+func DecodeStreamMetadata(s string) (StreamMetadata, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return StreamMetadata{}, err
+	}
+	return ReadStreamMetadata(bytes.NewReader(data))
+}
+
+// ReadControlRequest reads a control request
+func ReadControlRequest(r io.Reader) (ControlRequest, error) {
+	var req ControlRequest
+	err := readFields(r, func(tag byte, r io.Reader) error {
+		switch tag {
+		case fieldWeight:
+			req.ChangeWeight = true
+			return Read(r, &req.Weight)
+		}
+		return nil
+	})
+	return req, err
+}
+
+// WriteControlRequest writes a control request
+func WriteControlRequest(w io.Writer, req ControlRequest) error {
+	var fields []field
+	if req.ChangeWeight {
+		fields = append(fields, field{fieldWeight, []interface{}{req.Weight}})
+	}
+	return writeFields(w, fields...)
+}
+
+// ReadControlResponse reads the reply to a control request
+func ReadControlResponse(r io.Reader) (ControlResponse, error) {
+	var res ControlResponse
+	err := readFields(r, func(tag byte, r io.Reader) error {
+		switch tag {
+		case fieldResult:
+			return Read(r, (*int)(&res.Code), &res.Message)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// WriteControlResponse writes the reply to a control request
+func WriteControlResponse(w io.Writer, res ControlResponse) error {
+	return writeFields(w, field{fieldResult, []interface{}{int(res.Code), res.Message}})
+}
+
+// Err returns the error described by the response, or nil if the request
+// succeeded
+func (res ControlResponse) Err() error {
+	if res.Code != CodeOK {
+		return &HandshakeError{Code: res.Code, Message: res.Message}
+	}
+	return nil
 }
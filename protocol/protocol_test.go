@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	def := SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP: &SocketHTTPDefinition{
+			PathPrefix: "/a/",
+		},
+	}
+
+	for _, version := range []int{0, Version} {
+		var buf bytes.Buffer
+		err := WriteHandshakeRequest(&buf, HandshakeRequest{
+			Version:          version,
+			SocketDefinition: def,
+		})
+		if err != nil {
+			t.Errorf("error writing request: %v", err)
+			return
+		}
+		req, err := ReadHandshakeRequest(&buf)
+		if err != nil {
+			t.Errorf("error reading request: %v", err)
+			return
+		}
+		if req.Version != version {
+			t.Errorf("expected version %v got %v", version, req.Version)
+		}
+		if req.SocketDefinition.Port != def.Port ||
+			req.SocketDefinition.HTTP == nil ||
+			req.SocketDefinition.HTTP.PathPrefix != def.HTTP.PathPrefix {
+			t.Errorf("expected %v got %v", def, req.SocketDefinition)
+		}
+
+		buf.Reset()
+		err = WriteHandshakeResponse(&buf, HandshakeResponse{
+			Version: version,
+			Status:  "OK",
+		})
+		if err != nil {
+			t.Errorf("error writing response: %v", err)
+			return
+		}
+		res, err := ReadHandshakeResponse(&buf)
+		if err != nil {
+			t.Errorf("error reading response: %v", err)
+			return
+		}
+		if res.Version != version || res.Status != "OK" {
+			t.Errorf("expected version %v and `OK` got %v and `%v`", version, res.Version, res.Status)
+		}
+	}
+}
+
+func TestHandshakeError(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteHandshakeResponse(&buf, HandshakeResponse{
+		Version: Version,
+		Status:  "address already in use",
+		Code:    CodePortInUse,
+		Message: "address already in use",
+	})
+	if err != nil {
+		t.Errorf("error writing response: %v", err)
+		return
+	}
+	res, err := ReadHandshakeResponse(&buf)
+	if err != nil {
+		t.Errorf("error reading response: %v", err)
+		return
+	}
+	err = res.Err()
+	if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("expected %v got %v", ErrPortInUse, err)
+	}
+	if errors.Is(err, ErrInvalidCert) {
+		t.Errorf("expected %v not to match %v", err, ErrInvalidCert)
+	}
+
+	// legacy servers only send a status
+	buf.Reset()
+	WriteHandshakeResponse(&buf, HandshakeResponse{Status: "failed"})
+	res, err = ReadHandshakeResponse(&buf)
+	if err != nil {
+		t.Errorf("error reading response: %v", err)
+		return
+	}
+	if !errors.Is(res.Err(), ErrUnknown) {
+		t.Errorf("expected %v got %v", ErrUnknown, res.Err())
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	for _, sz := range []int{1 << 62, -1, maxSize + 1} {
+		var buf bytes.Buffer
+		buf.WriteString(Magic)
+		Write(&buf, Version, 0, sz)
+		_, err := ReadHandshakeRequest(&buf)
+		if err == nil {
+			t.Errorf("expected an error for an address of length %d", sz)
+		}
+	}
+
+	var buf bytes.Buffer
+	Write(&buf, 1<<62)
+	var ss []string
+	err := Read(&buf, &ss)
+	if err == nil {
+		t.Errorf("expected an error for a list of length %d", 1<<62)
+	}
+}
+
+func TestBalanceWeight(t *testing.T) {
+	zero, five := 0, 5
+	for _, weight := range []*int{nil, &zero, &five} {
+		var buf bytes.Buffer
+		err := WriteHandshakeRequest(&buf, HandshakeRequest{
+			Version: Version,
+			SocketDefinition: SocketDefinition{
+				Balance: &SocketBalanceDefinition{Weight: weight},
+			},
+		})
+		if err != nil {
+			t.Errorf("error writing request: %v", err)
+			return
+		}
+		req, err := ReadHandshakeRequest(&buf)
+		if err != nil {
+			t.Errorf("error reading request: %v", err)
+			return
+		}
+		b := req.SocketDefinition.Balance
+		if b == nil {
+			t.Errorf("expected a balance definition")
+			return
+		}
+		if (weight == nil) != (b.Weight == nil) || (weight != nil && *weight != *b.Weight) {
+			t.Errorf("expected weight %v got %v", weight, b.Weight)
+		}
+	}
+}
+
+func TestControlRequest(t *testing.T) {
+	for _, req := range []ControlRequest{{}, {ChangeWeight: true}, {ChangeWeight: true, Weight: 5}} {
+		var buf bytes.Buffer
+		err := WriteControlRequest(&buf, req)
+		if err != nil {
+			t.Errorf("error writing request: %v", err)
+			return
+		}
+		got, err := ReadControlRequest(&buf)
+		if err != nil {
+			t.Errorf("error reading request: %v", err)
+			return
+		}
+		if got != req {
+			t.Errorf("expected %v got %v", req, got)
+		}
+	}
+}
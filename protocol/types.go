@@ -1,22 +1,263 @@
 package protocol
 
+import "time"
+
+const (
+	// Magic starts every versioned handshake. Legacy handshakes start with an
+	// 8 byte length instead, which will never look like this.
+	Magic = "SOCKMSTR"
+	// Version is the newest handshake version this package speaks
+	Version = 1
+	// SupportedCapabilities are the capabilities this package understands
+	SupportedCapabilities = CapabilityStreamMetadata | CapabilityControl | CapabilityHealthCheck
+)
+
+const (
+	// CapabilityStreamMetadata means every stream opened to the downstream
+	// starts with its StreamMetadata
+	CapabilityStreamMetadata Capabilities = 1 << iota
+	// CapabilityControl means the client may open streams to the server to
+	// change its registration with a ControlRequest
+	CapabilityControl
+	// CapabilityHealthCheck means the client answers streams whose metadata
+	// marks them as health checks itself instead of accepting them
+	CapabilityHealthCheck
+)
+
+// tags for the fields of a versioned handshake and of stream metadata
+const (
+	fieldEnd byte = iota
+	fieldResult
+	fieldListener
+	fieldToken
+	fieldRemoteAddress
+	fieldLocalAddress
+	fieldTLS
+	fieldProxyProtocol
+	fieldBalance
+	fieldBalanceHash
+	fieldWeight
+	fieldHTTPMatch
+	fieldHTTPRewrite
+	fieldHealthCheck
+	fieldHTTPErrorPage
+	fieldMissingRouteTimeout
+	fieldTLSClientCert
+)
+
+// load balancing strategies
+const (
+	BalanceRandom      = "random"
+	BalanceRoundRobin  = "round-robin"
+	BalanceLeastActive = "least-active"
+	BalanceWeighted    = "weighted"
+	// BalanceTwoChoices picks two downstreams at random and uses the one with
+	// fewer active streams
+	BalanceTwoChoices = "two-choices"
+	// BalanceConsistentHash sends each client to the same downstream for as
+	// long as it's registered
+	BalanceConsistentHash = "consistent-hash"
+)
+
+// health check types
+const (
+	// HealthCheckPing measures the latency of a yamux ping
+	HealthCheckPing = "ping"
+	// HealthCheckTCP opens a stream and waits for the client to answer it.
+	// Clients without CapabilityHealthCheck are pinged instead.
+	HealthCheckTCP = "tcp"
+	// HealthCheckHTTP sends a GET request and checks the response status
+	HealthCheckHTTP = "http"
+)
+
 type (
+	// Capabilities is a bitmap of optional protocol features. Clients send the
+	// capabilities they support and the server replies with the subset both
+	// sides understand.
+	Capabilities int
+
+	field struct {
+		tag  byte
+		args []interface{}
+	}
 	SocketHTTPDefinition struct {
+		// DomainSuffix matches hosts equal to it or ending in it at a label
+		// boundary, so "example.com" matches "www.example.com" but not
+		// "badexample.com". PathPrefix must start the request path.
 		DomainSuffix, PathPrefix string
+		// Host matches the request host exactly. A "*." prefix matches any
+		// subdomain instead. Hosts are matched without their port and
+		// regardless of case.
+		Host string
+		// Methods, if set, are the request methods routed to the socket
+		Methods []string
+		// Headers and Query are predicates on the request headers and query
+		// parameters. An empty value only requires the key to be present.
+		Headers map[string]string
+		Query   map[string]string
+		// PathRegex, if set, must match the request path
+		PathRegex string
+		// Rewrite changes requests before they're sent to the downstream
+		Rewrite *SocketHTTPRewriteDefinition
+		// ErrorPages customize the responses the socket master generates for
+		// the route
+		ErrorPages []SocketHTTPErrorPage
+	}
+	// SocketHTTPErrorPage is the body of a 502, 503 or 504 response generated
+	// by the socket master
+	SocketHTTPErrorPage struct {
+		// Status is the status code the page is used for, or 0 for all of them
+		Status int
+		// ContentType is the page's media type. If there are several pages for
+		// a status the first one the client accepts is used.
+		ContentType string
+		// Template is a text/template (an html/template for text/html pages)
+		// executed with the Status, StatusText, Method, Host and Path of the
+		// request. A json function is available for JSON pages.
+		Template string
+	}
+	// SocketHTTPRewriteDefinition describes how requests (and their responses)
+	// are rewritten. The path is rewritten by stripping the prefix, then
+	// replacing PathRegex and finally adding AddPrefix.
+	SocketHTTPRewriteDefinition struct {
+		// StripPrefix removes the route's PathPrefix from the path
+		StripPrefix bool
+		AddPrefix   string
+		// PathRegex matches are replaced with PathReplacement, which may refer
+		// to submatches with $1 etc.
+		PathRegex, PathReplacement string
+		// Host overrides the Host header
+		Host string
+		// RequestHeaders and ResponseHeaders are set, replacing existing
+		// values. The Remove lists are removed.
+		RequestHeaders        map[string]string
+		RemoveRequestHeaders  []string
+		ResponseHeaders       map[string]string
+		RemoveResponseHeaders []string
 	}
 	SocketTLSDefinition struct {
 		Cert, Key string
+		// RequestClientCert asks clients connecting to the certificate's names
+		// for an (optional) client certificate, whose subject is passed along
+		// in the stream metadata
+		RequestClientCert bool
+	}
+	// SocketProxyProtocolDefinition controls HAProxy PROXY protocol support
+	SocketProxyProtocolDefinition struct {
+		// Accept means connections to the upstream listener start with a PROXY
+		// header (v1 or v2) describing the original client
+		Accept bool
+		// Send is the PROXY protocol version (1 or 2) to start streams to the
+		// downstream with, or 0 for none
+		Send int
+	}
+	// SocketBalanceDefinition controls how traffic is shared between
+	// downstreams registered for the same socket (or HTTP route)
+	SocketBalanceDefinition struct {
+		// Strategy is one of the Balance constants. The strategy of the oldest
+		// registration for a route is used.
+		Strategy string
+		// Weight is used by the weighted strategy. If it's nil the default of
+		// 100 is used. A weight of 0 sends the downstream no traffic until
+		// its weight is raised.
+		Weight *int
+		// HashCookie or HashHeader name the cookie or header used to identify
+		// HTTP clients for the consistent-hash strategy. By default (and for
+		// TCP) the client IP is used.
+		HashCookie string
+		HashHeader string
+	}
+	// SocketHealthCheckDefinition describes how the socket master checks
+	// that a downstream is healthy. Unhealthy downstreams receive no traffic
+	// until they recover. Zero values use the defaults.
+	SocketHealthCheckDefinition struct {
+		// Type is one of the HealthCheck constants
+		Type string
+		// Path and ExpectedStatus are used by HTTP checks. The path defaults to
+		// the route's PathPrefix and the status to 200. The route's Rewrite is
+		// applied to the check like any other request.
+		Path           string
+		ExpectedStatus int
+		// Interval is the time between checks (default 10s). Timeout limits
+		// each check (default 5s) and is the maximum ping latency.
+		Interval, Timeout time.Duration
+		// UnhealthyThreshold consecutive failures (default 3) take the
+		// downstream out of rotation and HealthyThreshold consecutive
+		// successes (default 2) bring it back
+		UnhealthyThreshold, HealthyThreshold int
 	}
 	SocketDefinition struct {
-		Address string
-		Port    int
-		TLS     *SocketTLSDefinition
-		HTTP    *SocketHTTPDefinition
+		Address       string
+		Port          int
+		TLS           *SocketTLSDefinition
+		HTTP          *SocketHTTPDefinition
+		ProxyProtocol *SocketProxyProtocolDefinition
+		Balance       *SocketBalanceDefinition
+		HealthCheck   *SocketHealthCheckDefinition
+		// MissingRouteTimeout overrides how long the server's connections (or
+		// HTTP requests) wait for a downstream for the socket when none is
+		// available. Zero uses the server's Config.MissingRouteTimeout, or an
+		// earlier registration's override for the same route.
+		MissingRouteTimeout time.Duration
 	}
 	HandshakeRequest struct {
+		// Version is the newest version the client speaks, 0 for legacy clients
+		Version          int
+		Capabilities     Capabilities
 		SocketDefinition SocketDefinition
+		// Token is a credential checked by the server's authenticator
+		Token string
+		// Peer identifies the process registering over a unix socket. It's set
+		// by the server (where supported) and never sent.
+		Peer *Credentials
+	}
+	// Credentials identify the process on the other end of a unix socket
+	Credentials struct {
+		PID, UID, GID int
 	}
 	HandshakeResponse struct {
-		Status string
+		// Version is the negotiated version, 0 for legacy clients
+		Version      int
+		Capabilities Capabilities
+		// Status is "OK" on success and the error message otherwise. It's the
+		// only thing legacy clients see.
+		Status  string
+		Code    ErrorCode
+		Message string
+		// Address and Port are what the upstream listener is bound to
+		Address string
+		Port    int
+	}
+	// StreamMetadata describes the upstream connection a stream was opened for
+	StreamMetadata struct {
+		RemoteIP   string
+		RemotePort int
+		LocalIP    string
+		LocalPort  int
+		// TLS is set if the socket master terminated TLS for the connection
+		TLS *StreamTLSMetadata
+		// HealthCheck marks streams opened by a TCP health check
+		HealthCheck bool
+	}
+	StreamTLSMetadata struct {
+		// ServerName is the SNI server name requested by the client
+		ServerName string
+		// NegotiatedProtocol is the ALPN protocol
+		NegotiatedProtocol string
+		// ClientCertSubject is the subject of the client's certificate, if it
+		// sent one
+		ClientCertSubject string
+	}
+	// A ControlRequest changes a registration at runtime. It's sent by the
+	// client on a stream it opens once CapabilityControl was negotiated.
+	ControlRequest struct {
+		// ChangeWeight means Weight is the downstream's new balancing weight.
+		// A weight of 0 stops its traffic on weighted routes.
+		ChangeWeight bool
+		Weight       int
+	}
+	ControlResponse struct {
+		Code    ErrorCode
+		Message string
 	}
 )
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+type (
+	// An Authenticator decides whether a downstream connection may register
+	// the socket it asked for. Returning an error rejects the handshake.
+	Authenticator interface {
+		Authenticate(conn net.Conn, req protocol.HandshakeRequest) error
+	}
+	// AuthenticatorFunc adapts a function to the Authenticator interface
+	AuthenticatorFunc func(conn net.Conn, req protocol.HandshakeRequest) error
+	// An Allowance limits what an authenticated downstream may claim. An empty
+	// list allows anything.
+	Allowance struct {
+		Ports []int
+		// Domains are the domains (and their subdomains) HTTP routes and TLS
+		// certificates may use
+		Domains []string
+		// PathPrefixes are the paths HTTP routes must start with
+		PathPrefixes []string
+	}
+	// TokenAuthenticator authenticates downstreams with pre-shared keys mapped
+	// to what each of them is allowed to claim
+	TokenAuthenticator map[string]Allowance
+	// HMACAuthenticator authenticates downstreams with tokens created by
+	// protocol.HMACToken. Allowances are keyed by the identity in the token.
+	HMACAuthenticator struct {
+		Secret     []byte
+		Allowances map[string]Allowance
+	}
+)
+
+func (f AuthenticatorFunc) Authenticate(conn net.Conn, req protocol.HandshakeRequest) error {
+	return f(conn, req)
+}
+
+func (ta TokenAuthenticator) Authenticate(conn net.Conn, req protocol.HandshakeRequest) error {
+	for token, allowance := range ta {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(req.Token)) == 1 {
+			return allowance.check(req.SocketDefinition)
+		}
+	}
+	return permissionDenied("invalid token")
+}
+
+func (ha *HMACAuthenticator) Authenticate(conn net.Conn, req protocol.HandshakeRequest) error {
+	identity, ok := protocol.ParseHMACToken(ha.Secret, req.Token)
+	if !ok {
+		return permissionDenied("invalid token")
+	}
+	allowance, ok := ha.Allowances[identity]
+	if !ok {
+		return permissionDenied(fmt.Sprintf("unknown identity: %s", identity))
+	}
+	return allowance.check(req.SocketDefinition)
+}
+
+// check returns an error if the socket definition isn't allowed
+func (a Allowance) check(def protocol.SocketDefinition) error {
+	if len(a.Ports) > 0 {
+		found := false
+		for _, port := range a.Ports {
+			if port == def.Port {
+				found = true
+			}
+		}
+		if !found {
+			return permissionDenied(fmt.Sprintf("port %d is not allowed", def.Port))
+		}
+	}
+
+	if len(a.Domains) == 0 && len(a.PathPrefixes) == 0 {
+		return nil
+	}
+	// a plain TCP socket would receive every request on the port
+	if def.HTTP == nil {
+		return permissionDenied("only HTTP routes are allowed")
+	}
+
+	if len(a.Domains) > 0 {
+		// requests have to match both the host and the domain suffix, so
+		// either being allowed is enough
+		names := []string{def.HTTP.DomainSuffix}
+		if def.HTTP.Host != "" {
+			names = append(names, def.HTTP.Host)
+		}
+		found := false
+		for _, name := range names {
+			if a.allowsDomain(name) {
+				found = true
+			}
+		}
+		if !found {
+			return permissionDenied(fmt.Sprintf("domain %q is not allowed", names[len(names)-1]))
+		}
+
+		// a certificate is served for every name in it, and one without names
+		// is served to clients whose names no other certificate has
+		if def.TLS != nil {
+			names, err := certificateNames(def.TLS)
+			if err != nil {
+				// left for the server to reject as an invalid certificate
+				return nil
+			}
+			if len(names) == 0 {
+				return permissionDenied("certificates without names are not allowed")
+			}
+			for _, name := range names {
+				if !a.allowsDomain(name) {
+					return permissionDenied(fmt.Sprintf("certificate name %q is not allowed", name))
+				}
+			}
+		}
+	}
+
+	if len(a.PathPrefixes) > 0 {
+		found := false
+		for _, prefix := range a.PathPrefixes {
+			if strings.HasPrefix(def.HTTP.PathPrefix, prefix) {
+				found = true
+			}
+		}
+		if !found {
+			return permissionDenied(fmt.Sprintf("path prefix %q is not allowed", def.HTTP.PathPrefix))
+		}
+	}
+
+	return nil
+}
+
+// allowsDomain returns true if name (which may be a wildcard) is one of the
+// allowed domains or a subdomain of one
+func (a Allowance) allowsDomain(name string) bool {
+	name = strings.ToLower(strings.TrimPrefix(name, "*."))
+	for _, domain := range a.Domains {
+		domain = strings.ToLower(domain)
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateNames returns the names a certificate is served for, which are
+// the same ones tls.Config.BuildNameToCertificate uses
+func certificateNames(def *protocol.SocketTLSDefinition) ([]string, error) {
+	cert, err := tls.X509KeyPair([]byte(def.Cert), []byte(def.Key))
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	names := leaf.DNSNames
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	return names, nil
+}
+
+func permissionDenied(msg string) error {
+	return &protocol.HandshakeError{
+		Code:    protocol.CodePermissionDenied,
+		Message: msg,
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+// newTestCert returns a self-signed certificate with the given names
+func newTestCert(commonName string, dnsNames ...string) (*protocol.SocketTLSDefinition, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.SocketTLSDefinition{
+		Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}, nil
+}
+
+func TestAllowanceTLS(t *testing.T) {
+	allowance := Allowance{Domains: []string{"a.example.com"}}
+	for _, test := range []struct {
+		commonName string
+		dnsNames   []string
+		allowed    bool
+	}{
+		{"", []string{"a.example.com", "*.a.example.com"}, true},
+		{"www.a.example.com", nil, true},
+		{"", []string{"a.example.com", "b.example.com"}, false},
+		{"b.example.com", []string{"a.example.com"}, false},
+		{"", nil, false},
+	} {
+		cert, err := newTestCert(test.commonName, test.dnsNames...)
+		if err != nil {
+			t.Errorf("error creating certificate: %v", err)
+			return
+		}
+		err = allowance.check(protocol.SocketDefinition{
+			Port: 443,
+			TLS:  cert,
+			HTTP: &protocol.SocketHTTPDefinition{DomainSuffix: "a.example.com"},
+		})
+		if test.allowed && err != nil {
+			t.Errorf("expected %q %v to be allowed got %v", test.commonName, test.dnsNames, err)
+		}
+		if !test.allowed && !errors.Is(err, protocol.ErrPermissionDenied) {
+			t.Errorf("expected %q %v to be denied got %v", test.commonName, test.dnsNames, err)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+const (
+	defaultWeight = 100
+	// hashReplicas is the number of virtual nodes each downstream has on a
+	// consistent hash ring
+	hashReplicas = 100
+)
+
+type (
+	// a balancer picks one of several equally suitable downstreams. key
+	// identifies the client.
+	balancer interface {
+		pick(ds []*downstreamConnection, key string) *downstreamConnection
+	}
+	randomBalancer     struct{}
+	roundRobinBalancer struct {
+		next uint64
+	}
+	leastActiveBalancer struct{}
+	weightedBalancer    struct{}
+	twoChoicesBalancer  struct{}
+	// a hashBalancer maps clients onto a ring of virtual nodes so adding or
+	// removing a downstream only moves the clients next to it
+	hashBalancer struct {
+		mu   sync.Mutex
+		ids  []int64
+		ring []hashNode
+	}
+	hashNode struct {
+		hash uint64
+		id   int64
+	}
+)
+
+func newBalancer(strategy string) (balancer, error) {
+	switch strategy {
+	case "", protocol.BalanceRandom:
+		return randomBalancer{}, nil
+	case protocol.BalanceRoundRobin:
+		return new(roundRobinBalancer), nil
+	case protocol.BalanceLeastActive:
+		return leastActiveBalancer{}, nil
+	case protocol.BalanceWeighted:
+		return weightedBalancer{}, nil
+	case protocol.BalanceTwoChoices:
+		return twoChoicesBalancer{}, nil
+	case protocol.BalanceConsistentHash:
+		return new(hashBalancer), nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy: %q", strategy)
+}
+
+func (randomBalancer) pick(ds []*downstreamConnection, key string) *downstreamConnection {
+	return ds[rand.Intn(len(ds))]
+}
+
+func (b *roundRobinBalancer) pick(ds []*downstreamConnection, key string) *downstreamConnection {
+	n := atomic.AddUint64(&b.next, 1)
+	return ds[int((n-1)%uint64(len(ds)))]
+}
+
+func (leastActiveBalancer) pick(ds []*downstreamConnection, key string) *downstreamConnection {
+	var best *downstreamConnection
+	var bestActive int64
+	ties := 0
+	for _, d := range ds {
+		active := atomic.LoadInt64(&d.active)
+		switch {
+		case best == nil || active < bestActive:
+			best, bestActive, ties = d, active, 1
+		case active == bestActive:
+			// pick uniformly among ties
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = d
+			}
+		}
+	}
+	return best
+}
+
+func (weightedBalancer) pick(ds []*downstreamConnection, key string) *downstreamConnection {
+	// weights may change at any time so read each one once
+	weights := make([]int, len(ds))
+	total := 0
+	for i, d := range ds {
+		weights[i] = d.weight()
+		total += weights[i]
+	}
+	if total <= 0 {
+		return ds[rand.Intn(len(ds))]
+	}
+	n := rand.Intn(total)
+	for i, d := range ds {
+		n -= weights[i]
+		if n < 0 {
+			return d
+		}
+	}
+	return ds[len(ds)-1]
+}
+
+func (twoChoicesBalancer) pick(ds []*downstreamConnection, key string) *downstreamConnection {
+	if len(ds) == 1 {
+		return ds[0]
+	}
+	i := rand.Intn(len(ds))
+	j := rand.Intn(len(ds) - 1)
+	if j >= i {
+		j++
+	}
+	if atomic.LoadInt64(&ds[j].active) < atomic.LoadInt64(&ds[i].active) {
+		return ds[j]
+	}
+	return ds[i]
+}
+
+func (b *hashBalancer) pick(ds []*downstreamConnection, key string) *downstreamConnection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// rebuild the ring when the set of downstreams changes
+	if !b.matches(ds) {
+		b.ids = b.ids[:0]
+		b.ring = b.ring[:0]
+		for _, d := range ds {
+			b.ids = append(b.ids, d.id)
+			for i := 0; i < hashReplicas; i++ {
+				b.ring = append(b.ring, hashNode{hash: hashKey(fmt.Sprint(d.id, "-", i)), id: d.id})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool {
+			return b.ring[i].hash < b.ring[j].hash
+		})
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= h
+	})
+	if i == len(b.ring) {
+		i = 0
+	}
+	for _, d := range ds {
+		if d.id == b.ring[i].id {
+			return d
+		}
+	}
+	return ds[0]
+}
+
+func (b *hashBalancer) matches(ds []*downstreamConnection) bool {
+	if len(ds) != len(b.ids) {
+		return false
+	}
+	for i, d := range ds {
+		if d.id != b.ids[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	return h.Sum64()
+}
+
+// weight returns the downstream's current balancing weight
+func (d *downstreamConnection) weight() int {
+	if w := atomic.LoadInt64(&d.currentWeight); w >= 0 {
+		return int(w)
+	}
+	if b := d.socketDefinition.Balance; b != nil && b.Weight != nil {
+		return *b.Weight
+	}
+	return defaultWeight
+}
+
+// checkWeight returns an error if weight can't be used on a route balanced
+// with strategy
+func checkWeight(strategy string, weight int) error {
+	switch {
+	case weight < 0:
+		return fmt.Errorf("invalid weight: %d", weight)
+	case strategy != "" && strategy != protocol.BalanceWeighted:
+		return fmt.Errorf("the %s strategy ignores weights", strategy)
+	}
+	return nil
+}
+
+// routeBalance returns the balancing definition of d's route, which is the
+// one the oldest downstream registered for it. u.mu must be held.
+func (u *upstreamListener) routeBalance(d *downstreamConnection) *protocol.SocketBalanceDefinition {
+	oldest := d
+	for _, o := range u.downstream {
+		if o.id < oldest.id && sameRoute(o, d) {
+			oldest = o
+		}
+	}
+	return oldest.socketDefinition.Balance
+}
+
+// strategy returns the balancing strategy d's route was registered with
+func (u *upstreamListener) strategy(d *downstreamConnection) string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	if b := u.routeBalance(d); b != nil {
+		return b.Strategy
+	}
+	return ""
+}
+
+// sameRoute returns true if a and b share traffic
+func sameRoute(a, b *downstreamConnection) bool {
+	if a.route == nil || b.route == nil {
+		return a.route == b.route
+	}
+	return a.route.key == b.route.key
+}
+
+// pick chooses one of several downstreams registered for the same route
+// using the route's balancing definition (see routeBalance) and reserves a
+// stream on it. ds must be sorted by id. req is nil for TCP routes. If every
+// downstream is at its stream limit errOverloaded is returned.
+func (u *upstreamListener) pick(route string, def *protocol.SocketBalanceDefinition, ds []*downstreamConnection, conn net.Conn, req *http.Request) (*downstreamConnection, error) {
+	var strategy string
+	if def != nil {
+		strategy = def.Strategy
+	}
+	// without an explicit strategy, setting weights splits traffic by weight
+	if strategy == "" {
+		for _, d := range ds {
+			if d.weight() != defaultWeight {
+				strategy = protocol.BalanceWeighted
+				break
+			}
+		}
+	}
+
+	u.balancerMu.Lock()
+	name := route + "\x00" + strategy
+	bal, ok := u.balancers[name]
+	if !ok {
+		bal, _ = newBalancer(strategy)
+		if bal == nil {
+			bal = randomBalancer{}
+		}
+		u.balancers[name] = bal
+	}
+	u.balancerMu.Unlock()
+
+	var key string
+	if strategy == protocol.BalanceConsistentHash {
+		key = clientKey(conn, req, def)
+	}
+
+	max := int64(u.server.config.MaxStreamsPerDownstream)
+	for len(ds) > 0 {
+		d := ds[0]
+		if len(ds) > 1 {
+			d = bal.pick(ds, key)
+		}
+		if d.acquire(max) {
+			return d, nil
+		}
+		// try the others
+		rest := make([]*downstreamConnection, 0, len(ds)-1)
+		for _, o := range ds {
+			if o != d {
+				rest = append(rest, o)
+			}
+		}
+		ds = rest
+	}
+	return nil, errOverloaded
+}
+
+// clientKey identifies the client of conn for consistent hashing. HTTP
+// clients can be identified by a cookie or header instead of their IP.
+func clientKey(conn net.Conn, req *http.Request, def *protocol.SocketBalanceDefinition) string {
+	if req != nil && def != nil {
+		if def.HashCookie != "" {
+			if c, err := req.Cookie(def.HashCookie); err == nil {
+				return c.Value
+			}
+		}
+		if def.HashHeader != "" {
+			if v := req.Header.Get(def.HashHeader); v != "" {
+				return v
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashBalancer(t *testing.T) {
+	var ds []*downstreamConnection
+	for i := 0; i < 4; i++ {
+		ds = append(ds, &downstreamConnection{id: int64(i)})
+	}
+
+	b := new(hashBalancer)
+	before := map[string]int64{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("client-", i)
+		before[key] = b.pick(ds, key).id
+		if id := b.pick(ds, key).id; id != before[key] {
+			t.Errorf("expected %v to stick to %v got %v", key, before[key], id)
+			return
+		}
+	}
+
+	// removing a downstream only moves its own clients
+	moved := 0
+	for key, id := range before {
+		got := b.pick(ds[:3], key).id
+		if id != 3 && got != id {
+			t.Errorf("expected %v to stay on %v got %v", key, id, got)
+			return
+		}
+		if got != id {
+			moved++
+		}
+	}
+	if moved == 0 || moved > 500 {
+		t.Errorf("expected roughly a quarter of the clients to move got %v", moved)
+	}
+}
@@ -2,19 +2,104 @@ package server
 
 import (
 	"log"
+	"net"
 	"os"
 	"time"
+
+	"github.com/badgerodon/socketmaster/protocol"
 )
 
 type (
 	Config struct {
-		// MissingRouteTimeout is the amount of time to keep trying to find a
-		// downstream connection for an upstream connection
+		// MissingRouteTimeout is the amount of time an upstream connection (or
+		// HTTP request) waits for a downstream connection when none is
+		// available. Sockets may override it.
 		MissingRouteTimeout time.Duration
 		// EmptyListenerTimeout is the amount of time to keep an existing upstream
 		// listener open
 		EmptyListenerTimeout time.Duration
-		Logger               *log.Logger
+		// HandshakeTimeout limits how long a downstream connection may take to
+		// send its handshake. Zero means no timeout.
+		HandshakeTimeout time.Duration
+		Logger           *log.Logger
+		// Authenticator, if set, decides which downstream connections may
+		// register sockets
+		Authenticator Authenticator
+		// Forwarded controls the headers added to requests routed to HTTP
+		// downstreams
+		Forwarded ForwardedConfig
+		// HTTP2Cleartext enables HTTP/2 with prior knowledge (h2c) on plaintext
+		// HTTP listeners. HTTP/2 is always negotiated on TLS listeners.
+		HTTP2Cleartext bool
+		// MaxIdleStreams is the number of idle keep-alive streams kept open to
+		// each HTTP downstream for reuse by later requests, from any client.
+		// Downstreams identify the client of each request with
+		// client.RequestMetadata instead.
+		MaxIdleStreams int
+		// IdleStreamTimeout is how long an idle stream is kept in the pool
+		IdleStreamTimeout time.Duration
+		// ResponseHeaderTimeout limits how long an HTTP downstream may take to
+		// respond to a request. Zero means no timeout.
+		ResponseHeaderTimeout time.Duration
+		// OutlierDetection ejects downstreams which keep failing
+		OutlierDetection OutlierDetectionConfig
+		// Retries controls retrying idempotent requests on other downstreams
+		Retries RetryConfig
+		// ErrorPages customize the 502, 503 and 504 responses the socket master
+		// generates. Routes can register their own pages which take
+		// precedence.
+		ErrorPages []protocol.SocketHTTPErrorPage
+		// RetryAfter is sent with 503 responses. Zero means no Retry-After
+		// header.
+		RetryAfter time.Duration
+		// MaxStreamsPerDownstream caps the number of concurrent streams to each
+		// downstream. Requests for a route whose downstreams are all at the
+		// limit are rejected with a 503. Zero means no limit.
+		MaxStreamsPerDownstream int
+	}
+	ForwardedConfig struct {
+		XForwardedFor   bool
+		XForwardedProto bool
+		XForwardedHost  bool
+		XRealIP         bool
+		// Forwarded is the RFC 7239 header
+		Forwarded bool
+		// TrustedProxies are the networks allowed to set forwarding headers
+		// themselves. Forwarding headers sent by anyone else are discarded.
+		TrustedProxies []*net.IPNet
+	}
+	RetryConfig struct {
+		// Attempts is the number of other downstreams an idempotent request is
+		// sent to when a downstream fails. Zero disables retries.
+		Attempts int
+		// BudgetRatio limits retries to this fraction of requests (plus a
+		// small burst) for each upstream listener
+		BudgetRatio float64
+		// MaxBufferedBody is the largest request body buffered so it can be
+		// sent again
+		MaxBufferedBody int64
+	}
+	// OutlierDetectionConfig ejects failing downstreams. It's off unless
+	// ConsecutiveFailures or FailureRate is set.
+	OutlierDetectionConfig struct {
+		// ConsecutiveFailures is the number of failures in a row (stream
+		// errors, timeouts and 5xx responses) that eject a downstream. Zero
+		// disables it.
+		ConsecutiveFailures int
+		// FailureRate ejects a downstream once this fraction of the requests
+		// it handled within Interval failed, provided there were at least
+		// MinRequests of them. Zero disables it.
+		FailureRate float64
+		MinRequests int
+		Interval    time.Duration
+		// EjectionTime is how long a downstream is first ejected for. It
+		// doubles with every ejection in a row up to MaxEjectionTime.
+		EjectionTime    time.Duration
+		MaxEjectionTime time.Duration
+		// MaxEjectedFraction is the largest fraction of a route's downstreams
+		// that may be ejected at once. Zero means no limit. The last
+		// available downstream of a route is never ejected.
+		MaxEjectedFraction float64
 	}
 )
 
@@ -23,6 +108,27 @@ func DefaultConfig() *Config {
 	return &Config{
 		MissingRouteTimeout:  time.Second * 30,
 		EmptyListenerTimeout: time.Second * 30,
+		HandshakeTimeout:     time.Second * 10,
 		Logger:               logger,
+		MaxIdleStreams:       16,
+		IdleStreamTimeout:    time.Second * 90,
+		RetryAfter:           time.Second * 5,
+		Retries: RetryConfig{
+			Attempts:        2,
+			BudgetRatio:     0.2,
+			MaxBufferedBody: 64 << 10,
+		},
+		OutlierDetection: OutlierDetectionConfig{
+			MinRequests:        20,
+			Interval:           time.Second * 10,
+			EjectionTime:       time.Second * 30,
+			MaxEjectionTime:    time.Minute * 5,
+			MaxEjectedFraction: 0.5,
+		},
+		Forwarded: ForwardedConfig{
+			XForwardedFor:   true,
+			XForwardedProto: true,
+			XForwardedHost:  true,
+		},
 	}
 }
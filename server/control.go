@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+// controlTimeout limits how long a control request may take
+const controlTimeout = 10 * time.Second
+
+// serveControl handles the control streams a downstream opens until its
+// session is closed
+func (u *upstreamListener) serveControl(d *downstreamConnection) {
+	for {
+		stream, err := d.session.Accept()
+		if err != nil {
+			return
+		}
+		go u.handleControl(d, stream)
+	}
+}
+
+func (u *upstreamListener) handleControl(d *downstreamConnection, stream net.Conn) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(controlTimeout))
+
+	logger := u.server.config.Logger
+	req, err := protocol.ReadControlRequest(stream)
+	if err != nil {
+		logger.Printf("error reading control request: %v\n", err)
+		return
+	}
+
+	var res protocol.ControlResponse
+	if req.ChangeWeight {
+		if err := checkWeight(u.strategy(d), req.Weight); err != nil {
+			res.Code = protocol.CodeInvalidDefinition
+			res.Message = err.Error()
+		} else {
+			logger.Printf("downstream %d weight set to %d\n", d.id, req.Weight)
+			atomic.StoreInt64(&d.currentWeight, int64(req.Weight))
+		}
+	}
+	err = protocol.WriteControlResponse(stream, res)
+	if err != nil {
+		logger.Printf("error writing control response: %v\n", err)
+	}
+}
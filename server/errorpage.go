@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+type (
+	// an errorPage is a compiled SocketHTTPErrorPage
+	errorPage struct {
+		status      int
+		contentType string
+		mediaType   string
+		tmpl        interface {
+			Execute(w io.Writer, data interface{}) error
+		}
+	}
+	// ErrorPageData is what error page templates are executed with
+	ErrorPageData struct {
+		Status     int
+		StatusText string
+		Method     string
+		Host       string
+		Path       string
+	}
+)
+
+var errorPageFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		bs, err := json.Marshal(v)
+		return string(bs), err
+	},
+}
+
+func compileErrorPages(pages []protocol.SocketHTTPErrorPage) ([]errorPage, error) {
+	compiled := make([]errorPage, 0, len(pages))
+	for _, page := range pages {
+		p := errorPage{
+			status:      page.Status,
+			contentType: page.ContentType,
+		}
+		if p.contentType == "" {
+			p.contentType = "text/plain; charset=utf-8"
+		}
+		var err error
+		p.mediaType, _, err = mime.ParseMediaType(p.contentType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page content type %q: %v", page.ContentType, err)
+		}
+		// escape what's reflected from the request in HTML pages
+		if p.mediaType == "text/html" {
+			p.tmpl, err = htmltemplate.New("error").Funcs(errorPageFuncs).Parse(page.Template)
+		} else {
+			p.tmpl, err = template.New("error").Funcs(errorPageFuncs).Parse(page.Template)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page template: %v", err)
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// findErrorPage returns the page for a status the client accepts, preferring
+// pages for that specific status
+func findErrorPage(pages []errorPage, req *http.Request, code int) *errorPage {
+	var candidates []*errorPage
+	for _, status := range []int{code, 0} {
+		for i := range pages {
+			if pages[i].status == status {
+				candidates = append(candidates, &pages[i])
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	accept := req.Header.Get("Accept")
+	for _, p := range candidates {
+		if strings.Contains(accept, p.mediaType) {
+			return p
+		}
+	}
+	return candidates[0]
+}
+
+// errorResponse builds the headers and body of a response generated by the
+// socket master. Pages registered for the request's route take precedence
+// over the global ones.
+func (u *upstreamListener) errorResponse(req *http.Request, code int) (http.Header, []byte) {
+	var page *errorPage
+	if r := u.matchRoute(req); r != nil {
+		page = findErrorPage(r.errorPages, req, code)
+	}
+	if page == nil {
+		page = findErrorPage(u.server.errorPages, req, code)
+	}
+
+	header := http.Header{}
+	body := []byte(http.StatusText(code))
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if page != nil {
+		var buf bytes.Buffer
+		err := page.tmpl.Execute(&buf, ErrorPageData{
+			Status:     code,
+			StatusText: http.StatusText(code),
+			Method:     req.Method,
+			Host:       req.Host,
+			Path:       req.URL.Path,
+		})
+		if err != nil {
+			u.server.config.Logger.Printf("error executing error page: %v\n", err)
+		} else {
+			body = buf.Bytes()
+			header.Set("Content-Type", page.contentType)
+		}
+	}
+	if code == http.StatusServiceUnavailable && u.server.config.RetryAfter > 0 {
+		seconds := int(math.Ceil(u.server.config.RetryAfter.Seconds()))
+		header.Set("Retry-After", strconv.Itoa(seconds))
+	}
+	header.Set("Cache-Control", "no-store")
+	return header, body
+}
+
+// writeError writes a response generated by the socket master. The
+// connection is closed afterwards.
+func (u *upstreamListener) writeError(w io.Writer, req *http.Request, code int) error {
+	header, body := u.errorResponse(req, code)
+	return (&http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+		Close:         true,
+	}).Write(w)
+}
+
+// serveError is writeError for HTTP/2 requests
+func (u *upstreamListener) serveError(res http.ResponseWriter, req *http.Request, code int) {
+	header, body := u.errorResponse(req, code)
+	for k, vs := range header {
+		res.Header()[k] = vs
+	}
+	res.WriteHeader(code)
+	res.Write(body)
+}
+
+// gatewayStatus returns the status for a request a downstream failed
+func gatewayStatus(err error) int {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
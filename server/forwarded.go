@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var forwardedHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Real-Ip",
+	"Forwarded",
+}
+
+func (cfg *ForwardedConfig) trusted(ip net.IP) bool {
+	for _, n := range cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders adds headers describing the client to a request before
+// it's sent to a downstream. Headers which were already present are only
+// kept if the client is a trusted proxy.
+func (cfg *ForwardedConfig) setForwardedHeaders(req *http.Request, conn net.Conn) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	if !cfg.trusted(addr.IP) {
+		for _, h := range forwardedHeaders {
+			req.Header.Del(h)
+		}
+	}
+
+	proto := "http"
+	if _, ok := conn.(*tls.Conn); ok {
+		proto = "https"
+	}
+
+	if cfg.XForwardedFor {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+addr.IP.String())
+		} else {
+			req.Header.Set("X-Forwarded-For", addr.IP.String())
+		}
+	}
+	if cfg.XForwardedProto && req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if cfg.XForwardedHost && req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if cfg.XRealIP && req.Header.Get("X-Real-Ip") == "" {
+		req.Header.Set("X-Real-Ip", addr.IP.String())
+	}
+	if cfg.Forwarded {
+		node := addr.IP.String()
+		if addr.IP.To4() == nil {
+			node = `"[` + node + `]"`
+		}
+		element := fmt.Sprintf("for=%s;proto=%s", node, proto)
+		if req.Host != "" {
+			element += fmt.Sprintf(";host=%q", req.Host)
+		}
+		if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+			req.Header.Set("Forwarded", strings.Join(prior, ", ")+", "+element)
+		} else {
+			req.Header.Set("Forwarded", element)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (conn remoteAddrConn) RemoteAddr() net.Addr {
+	return conn.addr
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg := ForwardedConfig{
+		XForwardedFor:   true,
+		XForwardedProto: true,
+		XForwardedHost:  true,
+		XRealIP:         true,
+		Forwarded:       true,
+		TrustedProxies:  []*net.IPNet{trusted},
+	}
+
+	tests := []struct {
+		remote string
+		xff    string
+		realIP string
+	}{
+		// spoofed headers from untrusted clients are discarded
+		{"192.168.0.1", "192.168.0.1", "192.168.0.1"},
+		// trusted proxies can pass them along
+		{"10.0.0.1", "1.2.3.4, 10.0.0.1", "1.2.3.4"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		req.Header.Set("X-Real-Ip", "1.2.3.4")
+		conn := remoteAddrConn{addr: &net.TCPAddr{IP: net.ParseIP(test.remote), Port: 1234}}
+		cfg.setForwardedHeaders(req, conn)
+
+		if v := req.Header.Get("X-Forwarded-For"); v != test.xff {
+			t.Errorf("expected X-Forwarded-For `%v` got `%v`", test.xff, v)
+		}
+		if v := req.Header.Get("X-Real-Ip"); v != test.realIP {
+			t.Errorf("expected X-Real-Ip `%v` got `%v`", test.realIP, v)
+		}
+		if v := req.Header.Get("X-Forwarded-Proto"); v != "http" {
+			t.Errorf("expected X-Forwarded-Proto `http` got `%v`", v)
+		}
+		if v := req.Header.Get("X-Forwarded-Host"); v != "example.com" {
+			t.Errorf("expected X-Forwarded-Host `example.com` got `%v`", v)
+		}
+		e := `for=` + test.remote + `;proto=http;host="example.com"`
+		if v := req.Header.Get("Forwarded"); v != e {
+			t.Errorf("expected Forwarded `%v` got `%v`", e, v)
+		}
+	}
+}
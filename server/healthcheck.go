@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultUnhealthyThreshold  = 3
+	defaultHealthyThreshold    = 2
+)
+
+// validateHealthCheck returns an error if a health check definition can't be
+// used
+func validateHealthCheck(def *protocol.SocketHealthCheckDefinition) error {
+	switch def.Type {
+	case protocol.HealthCheckPing, protocol.HealthCheckTCP, protocol.HealthCheckHTTP:
+	default:
+		return fmt.Errorf("unknown health check type: %q", def.Type)
+	}
+	if def.Interval < 0 || def.Timeout < 0 || def.ExpectedStatus < 0 ||
+		def.UnhealthyThreshold < 0 || def.HealthyThreshold < 0 {
+		return fmt.Errorf("invalid health check: %+v", *def)
+	}
+	return nil
+}
+
+// healthy returns false while health checks are failing
+func (d *downstreamConnection) healthy() bool {
+	return atomic.LoadInt32(&d.unhealthy) == 0
+}
+
+// healthCheck checks a downstream until its session is closed
+func (u *upstreamListener) healthCheck(d *downstreamConnection) {
+	def := *d.socketDefinition.HealthCheck
+	if def.Interval == 0 {
+		def.Interval = defaultHealthCheckInterval
+	}
+	if def.Timeout == 0 {
+		def.Timeout = defaultHealthCheckTimeout
+	}
+	if def.UnhealthyThreshold == 0 {
+		def.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if def.HealthyThreshold == 0 {
+		def.HealthyThreshold = defaultHealthyThreshold
+	}
+
+	ticker := time.NewTicker(def.Interval)
+	defer ticker.Stop()
+
+	var failures, successes int
+	for {
+		select {
+		case <-d.session.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		err := u.check(d, def)
+		if err != nil {
+			successes = 0
+			failures++
+			if failures >= def.UnhealthyThreshold && atomic.CompareAndSwapInt32(&d.unhealthy, 0, 1) {
+				u.server.config.Logger.Printf("downstream %d is unhealthy: %v\n", d.id, err)
+			}
+		} else {
+			failures = 0
+			successes++
+			if successes >= def.HealthyThreshold && atomic.CompareAndSwapInt32(&d.unhealthy, 1, 0) {
+				u.server.config.Logger.Printf("downstream %d is healthy again\n", d.id)
+				u.notify()
+			}
+		}
+	}
+}
+
+// check runs a single health check
+func (u *upstreamListener) check(d *downstreamConnection, def protocol.SocketHealthCheckDefinition) error {
+	switch def.Type {
+	case protocol.HealthCheckTCP:
+		if d.capabilities&protocol.CapabilityHealthCheck != 0 {
+			return u.checkTCP(d, def)
+		}
+	case protocol.HealthCheckHTTP:
+		return u.checkHTTP(d, def)
+	}
+	return checkPing(d, def)
+}
+
+func checkPing(d *downstreamConnection, def protocol.SocketHealthCheckDefinition) error {
+	done := make(chan error, 1)
+	go func() {
+		rtt, err := d.session.Ping()
+		if err == nil && rtt > def.Timeout {
+			err = fmt.Errorf("ping took %v", rtt)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(def.Timeout):
+		return fmt.Errorf("ping timed out")
+	}
+}
+
+// checkTCP opens a stream marked as a health check, which the client answers
+// from Accept
+func (u *upstreamListener) checkTCP(d *downstreamConnection, def protocol.SocketHealthCheckDefinition) error {
+	stream, err := d.session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(def.Timeout))
+
+	err = protocol.WriteStreamMetadata(stream, protocol.StreamMetadata{HealthCheck: true})
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(stream, make([]byte, 1))
+	return err
+}
+
+func (u *upstreamListener) checkHTTP(d *downstreamConnection, def protocol.SocketHealthCheckDefinition) error {
+	stream, err := u.openStream(d, nil)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(def.Timeout))
+
+	host := u.address
+	path := def.Path
+	if r := d.route; r != nil {
+		if r.host != "" && !r.wildcard {
+			host = r.host
+		}
+		if path == "" {
+			path = r.def.PathPrefix
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequest("GET", "http://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "socketmaster-health-check")
+	// probe the downstream the way requests routed to it see it
+	if r := d.route; r != nil && r.rewrite != nil {
+		r.rewrite.request(req)
+	}
+	req.Close = true
+	err = req.Write(stream)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	expected := def.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if res.StatusCode != expected {
+		return fmt.Errorf("expected status %d got %d", expected, res.StatusCode)
+	}
+	return nil
+}
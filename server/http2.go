@@ -0,0 +1,180 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http2PrefaceRequest is the part of the HTTP/2 connection preface that
+// http.ReadRequest parses as a "PRI * HTTP/2.0" request
+const http2PrefaceRequest = "PRI * HTTP/2.0\r\n\r\n"
+
+// hopHeaders are connection specific and not forwarded to HTTP/2 clients
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// a connListener is a net.Listener for a single connection, used to hand a
+// connection to an http.Server
+type connListener struct {
+	conn   net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (li *connListener) Accept() (net.Conn, error) {
+	if conn := li.conn; conn != nil {
+		li.conn = nil
+		return conn, nil
+	}
+	<-li.closed
+	return nil, io.EOF
+}
+
+func (li *connListener) Close() error {
+	li.once.Do(func() {
+		close(li.closed)
+	})
+	return nil
+}
+
+func (li *connListener) Addr() net.Addr {
+	return nil
+}
+
+// a prefixConn replays bytes which were already read from the connection
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (conn *prefixConn) Read(p []byte) (int, error) {
+	return conn.r.Read(p)
+}
+
+// routeHTTP2 serves an HTTP/2 connection. Every stream is routed on its own
+// so requests on the same connection may go to different downstreams.
+func (u *upstreamListener) routeHTTP2(conn net.Conn, h2c bool) {
+	li := newConnListener(conn)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			u.serveHTTP2(conn, res, req)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				li.Close()
+			}
+		},
+	}
+	if h2c {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	srv.Serve(li)
+}
+
+// serveHTTP2 forwards a single HTTP/2 request to a downstream as HTTP/1.1
+func (u *upstreamListener) serveHTTP2(conn net.Conn, res http.ResponseWriter, req *http.Request) {
+	var d *downstreamConnection
+	var err error
+	found := u.await(req.Context(), time.Now().Add(u.httpMissingRouteTimeout(req)), func() bool {
+		d, err = u.findDownstreamHTTP(req, conn, nil)
+		return d != nil || err != nil
+	})
+	if !found || err == errOverloaded {
+		u.serveError(res, req, http.StatusServiceUnavailable)
+		return
+	}
+
+	defer func() {
+		if d != nil {
+			d.release()
+		}
+	}()
+
+	bs, reused, err := u.getStream(d)
+	if err != nil {
+		u.server.config.Logger.Printf("failed to open stream: %v\n", err)
+		u.serveError(res, req, http.StatusBadGateway)
+		return
+	}
+
+	in := req.Clone(req.Context())
+	in.Proto, in.ProtoMajor, in.ProtoMinor = "HTTP/1.1", 1, 1
+	u.server.config.Forwarded.setForwardedHeaders(in, conn)
+	u.retries.deposit(u.server.config.Retries.BudgetRatio)
+	body, retryable := u.replayableBody(in)
+
+	var tried map[int64]bool
+	var backendRes *http.Response
+	for {
+		bs, _, backendRes, err = u.send(d, bs, reused, in, body, conn, nil)
+		if err == nil {
+			break
+		}
+		if retryable {
+			if tried == nil {
+				tried = map[int64]bool{}
+			}
+			d, bs, reused = u.retry(d, in, conn, tried)
+		}
+		if !retryable || d == nil {
+			u.serveError(res, req, gatewayStatus(err))
+			return
+		}
+	}
+	defer backendRes.Body.Close()
+	if rw := d.route.rewrite; rw != nil {
+		rw.response(backendRes.Header)
+	}
+
+	for k, vs := range backendRes.Header {
+		res.Header()[k] = vs
+	}
+	for _, h := range hopHeaders {
+		res.Header().Del(h)
+	}
+	res.WriteHeader(backendRes.StatusCode)
+
+	// flush as we go so streamed responses aren't held back
+	flusher, _ := res.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := backendRes.Body.Read(buf)
+		if n > 0 {
+			_, werr := res.Write(buf[:n])
+			if werr != nil {
+				bs.Close()
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF && !backendRes.Close {
+			u.putStream(d, bs)
+			return
+		}
+		if err != nil {
+			bs.Close()
+			return
+		}
+	}
+}
+
+// isHTTP2Preface returns true if req is the start of an HTTP/2 connection
+func isHTTP2Preface(req *http.Request) bool {
+	return req.Method == "PRI" && req.ProtoMajor == 2 && strings.TrimSpace(req.RequestURI) == "*"
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errOverloaded is returned when every downstream for a route is at its
+// stream limit
+var errOverloaded = errors.New("all downstreams are at their stream limit")
+
+// available returns true if the downstream should receive traffic
+func (d *downstreamConnection) available() bool {
+	return d.healthy() && time.Now().UnixNano() >= atomic.LoadInt64(&d.ejectedUntil)
+}
+
+// acquire reserves a stream on the downstream unless max streams are already
+// active. A max of zero means no limit.
+func (d *downstreamConnection) acquire(max int64) bool {
+	for {
+		active := atomic.LoadInt64(&d.active)
+		if max > 0 && active >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&d.active, active, active+1) {
+			return true
+		}
+	}
+}
+
+// release frees a stream reserved by acquire
+func (d *downstreamConnection) release() {
+	atomic.AddInt64(&d.active, -1)
+}
+
+// an outcomeWindow counts the requests and failures of a downstream since
+// start
+type outcomeWindow struct {
+	mu                 sync.Mutex
+	start              time.Time
+	requests, failures int
+}
+
+// add records the outcome of a request and returns true if the failure rate
+// is high enough to eject the downstream
+func (w *outcomeWindow) add(ok bool, cfg OutlierDetectionConfig) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.start) >= cfg.Interval {
+		w.start, w.requests, w.failures = now, 0, 0
+	}
+	w.requests++
+	if !ok {
+		w.failures++
+	}
+	if w.requests < cfg.MinRequests || float64(w.failures) < cfg.FailureRate*float64(w.requests) {
+		return false
+	}
+	w.start, w.requests, w.failures = now, 0, 0
+	return true
+}
+
+// observe records the outcome of a request to a downstream, ejecting it after
+// too many failures in a row or too high a failure rate
+func (u *upstreamListener) observe(d *downstreamConnection, ok bool) {
+	cfg := u.server.config.OutlierDetection
+	eject := false
+	if cfg.ConsecutiveFailures > 0 {
+		if ok {
+			atomic.StoreInt32(&d.failures, 0)
+		} else if atomic.AddInt32(&d.failures, 1) >= int32(cfg.ConsecutiveFailures) {
+			atomic.StoreInt32(&d.failures, 0)
+			eject = true
+		}
+	}
+	if cfg.FailureRate > 0 && d.outcomes.add(ok, cfg) {
+		eject = true
+	}
+	if ok && !eject {
+		atomic.StoreInt32(&d.ejections, 0)
+	}
+	if eject {
+		u.eject(d)
+	}
+}
+
+// eject takes a downstream out of rotation, for twice as long as the last
+// time if it was ejected again right after coming back. Downstreams aren't
+// ejected if that would leave their route without one or eject more than
+// MaxEjectedFraction of it.
+func (u *upstreamListener) eject(d *downstreamConnection) {
+	// the write lock keeps concurrent ejections from passing the checks
+	// together
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	cfg := u.server.config.OutlierDetection
+	now := time.Now().UnixNano()
+	total, ejected, available := 0, 0, 0
+	for _, o := range u.downstream {
+		if !sameRoute(o, d) {
+			continue
+		}
+		total++
+		if o == d {
+			continue
+		}
+		if now < atomic.LoadInt64(&o.ejectedUntil) {
+			ejected++
+		} else if o.healthy() {
+			available++
+		}
+	}
+	if available == 0 {
+		u.server.config.Logger.Printf("not ejecting downstream %d: it's the last one available\n", d.id)
+		return
+	}
+	if cfg.MaxEjectedFraction > 0 && float64(ejected+1) > cfg.MaxEjectedFraction*float64(total) {
+		u.server.config.Logger.Printf("not ejecting downstream %d: too many are ejected\n", d.id)
+		return
+	}
+
+	ejections := atomic.AddInt32(&d.ejections, 1)
+	ejection := cfg.EjectionTime
+	for i := int32(1); i < ejections && ejection < cfg.MaxEjectionTime; i++ {
+		ejection *= 2
+	}
+	if ejection > cfg.MaxEjectionTime && cfg.MaxEjectionTime > 0 {
+		ejection = cfg.MaxEjectionTime
+	}
+	atomic.StoreInt64(&d.ejectedUntil, now+int64(ejection))
+	time.AfterFunc(ejection, u.notify)
+	u.server.config.Logger.Printf("ejecting downstream %d for %v\n", d.id, ejection)
+}
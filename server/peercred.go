@@ -0,0 +1,6 @@
+package server
+
+import "github.com/badgerodon/socketmaster/protocol"
+
+// Credentials identify the process on the other end of a unix socket
+type Credentials = protocol.Credentials
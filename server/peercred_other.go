@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// PeerCredentials returns the credentials of the process on the other end of
+// a unix socket connection. It's only supported on linux.
+func PeerCredentials(conn net.Conn) (*Credentials, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on %s", runtime.GOOS)
+}
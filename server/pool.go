@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+type (
+	// a backendStream is a stream to a downstream that speaks HTTP/1.1 and can
+	// be kept alive between requests
+	backendStream struct {
+		stream    *yamux.Stream
+		reader    *bufio.Reader
+		idleSince time.Time
+	}
+	// a streamPool holds the idle streams of a downstream
+	streamPool struct {
+		idle []*backendStream
+		mu   sync.Mutex
+	}
+)
+
+func (bs *backendStream) Close() error {
+	return bs.stream.Close()
+}
+
+// getStream returns an idle stream to the downstream if there is one and
+// opens a new one otherwise. reused reports whether the stream was pooled.
+// Streams are shared by clients so they carry no client's metadata.
+func (u *upstreamListener) getStream(d *downstreamConnection) (bs *backendStream, reused bool, err error) {
+	timeout := u.server.config.IdleStreamTimeout
+	d.pool.mu.Lock()
+	for len(d.pool.idle) > 0 {
+		bs = d.pool.idle[len(d.pool.idle)-1]
+		d.pool.idle = d.pool.idle[:len(d.pool.idle)-1]
+		if timeout <= 0 || time.Since(bs.idleSince) < timeout {
+			d.pool.mu.Unlock()
+			return bs, true, nil
+		}
+		bs.Close()
+	}
+	d.pool.mu.Unlock()
+
+	stream, err := u.openStream(d, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return &backendStream{stream: stream, reader: bufio.NewReader(stream)}, false, nil
+}
+
+// putStream returns a stream to the downstream's pool once a request on it
+// has completed
+func (u *upstreamListener) putStream(d *downstreamConnection, bs *backendStream) {
+	d.pool.mu.Lock()
+	defer d.pool.mu.Unlock()
+
+	if len(d.pool.idle) >= u.server.config.MaxIdleStreams || d.session.IsClosed() {
+		bs.Close()
+		return
+	}
+	bs.idleSince = time.Now()
+	d.pool.idle = append(d.pool.idle, bs)
+}
+
+// prune closes streams which have been idle for longer than timeout
+func (p *streamPool) prune(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// streams are appended as they become idle so the oldest come first
+	n := 0
+	for n < len(p.idle) && time.Since(p.idle[n].idleSince) >= timeout {
+		p.idle[n].Close()
+		n++
+	}
+	p.idle = append(p.idle[:0], p.idle[n:]...)
+}
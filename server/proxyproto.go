@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// a proxyConn reports the addresses from a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	remoteAddr, localAddr net.Addr
+}
+
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	if conn.remoteAddr == nil {
+		return conn.Conn.RemoteAddr()
+	}
+	return conn.remoteAddr
+}
+
+func (conn *proxyConn) LocalAddr() net.Addr {
+	if conn.localAddr == nil {
+		return conn.Conn.LocalAddr()
+	}
+	return conn.localAddr
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from r. The source
+// and destination are nil if the header doesn't describe a TCP connection
+// (UNKNOWN in v1 or LOCAL in v2).
+func readProxyHeader(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	start := make([]byte, 5)
+	_, err = io.ReadFull(r, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(start) == "PROXY" {
+		return readProxyHeaderV1(r)
+	}
+	if bytes.Equal(start, proxyV2Signature[:5]) {
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil, fmt.Errorf("invalid proxy protocol header")
+}
+
+func readProxyHeaderV1(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	// the whole line is at most 107 bytes, read it one byte at a time so
+	// nothing after it is consumed
+	line := make([]byte, 0, 107)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, nil, fmt.Errorf("proxy protocol header too long")
+		}
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	parts := strings.Fields(string(line))
+	if len(parts) > 0 && parts[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(parts) != 5 || (parts[0] != "TCP4" && parts[0] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid proxy protocol header: %q", line)
+	}
+	src, err = parseProxyAddr(parts[1], parts[3])
+	if err == nil {
+		dst, err = parseProxyAddr(parts[2], parts[4])
+	}
+	return src, dst, err
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid proxy protocol address: %q", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("invalid proxy protocol port: %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func readProxyHeaderV2(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	hdr := make([]byte, 11)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:7], proxyV2Signature[5:]) {
+		return nil, nil, fmt.Errorf("invalid proxy protocol header")
+	}
+	verCmd, family := hdr[7], hdr[8]
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol version: %d", verCmd>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[9:]))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections (health checks from the proxy itself) and unknown
+	// families keep the real connection addresses
+	if verCmd&0xF == 0 {
+		return nil, nil, nil
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, nil, fmt.Errorf("proxy protocol header too short")
+		}
+		src = &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}
+		dst = &net.TCPAddr{IP: net.IP(data[4:8]), Port: int(binary.BigEndian.Uint16(data[10:]))}
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, nil, fmt.Errorf("proxy protocol header too short")
+		}
+		src = &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}
+		dst = &net.TCPAddr{IP: net.IP(data[16:32]), Port: int(binary.BigEndian.Uint16(data[34:]))}
+	}
+	return src, dst, nil
+}
+
+// writeProxyHeader writes a PROXY protocol header of the given version
+// describing a connection from src to dst
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	ok := sok && dok
+	ipv4 := ok && s.IP.To4() != nil && d.IP.To4() != nil
+
+	var buf bytes.Buffer
+	switch version {
+	case 1:
+		switch {
+		case !ok:
+			buf.WriteString("PROXY UNKNOWN\r\n")
+		case ipv4:
+			fmt.Fprintf(&buf, "PROXY TCP4 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port)
+		default:
+			fmt.Fprintf(&buf, "PROXY TCP6 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port)
+		}
+	case 2:
+		buf.Write(proxyV2Signature)
+		var addrs []byte
+		switch {
+		case !ok:
+			buf.Write([]byte{0x20, 0x00})
+		case ipv4:
+			buf.Write([]byte{0x21, 0x11})
+			addrs = append(addrs, s.IP.To4()...)
+			addrs = append(addrs, d.IP.To4()...)
+		default:
+			buf.Write([]byte{0x21, 0x21})
+			addrs = append(addrs, s.IP.To16()...)
+			addrs = append(addrs, d.IP.To16()...)
+		}
+		if ok {
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+		buf.Write(addrs)
+	default:
+		return fmt.Errorf("unsupported proxy protocol version: %d", version)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
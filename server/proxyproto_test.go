@@ -0,0 +1,42 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	addrs := [][2]*net.TCPAddr{
+		{{IP: net.ParseIP("1.2.3.4"), Port: 5678}, {IP: net.ParseIP("5.6.7.8"), Port: 80}},
+		{{IP: net.ParseIP("2001:db8::1"), Port: 5678}, {IP: net.ParseIP("2001:db8::2"), Port: 443}},
+	}
+	for _, version := range []int{1, 2} {
+		for _, addr := range addrs {
+			var buf bytes.Buffer
+			err := writeProxyHeader(&buf, version, addr[0], addr[1])
+			if err != nil {
+				t.Errorf("error writing v%d header: %v", version, err)
+				continue
+			}
+			buf.WriteString("Hello World")
+
+			src, dst, err := readProxyHeader(&buf)
+			if err != nil {
+				t.Errorf("error reading v%d header: %v", version, err)
+				continue
+			}
+			if src.String() != addr[0].String() || dst.String() != addr[1].String() {
+				t.Errorf("expected %v -> %v got %v -> %v", addr[0], addr[1], src, dst)
+			}
+			if buf.String() != "Hello World" {
+				t.Errorf("expected the rest of the stream to be untouched got `%v`", buf.String())
+			}
+		}
+	}
+
+	_, _, err := readProxyHeader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n")))
+	if err == nil {
+		t.Error("expected an error for a missing header")
+	}
+}
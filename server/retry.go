@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+// retryBurst is the number of retries allowed on top of the budget ratio
+const retryBurst = 10
+
+// a retryBudget limits retries to a fraction of the requests an upstream
+// listener handles so retries can't snowball during an outage
+type retryBudget struct {
+	mu   sync.Mutex
+	debt float64
+}
+
+// deposit records a request
+func (b *retryBudget) deposit(ratio float64) {
+	b.mu.Lock()
+	b.debt -= ratio
+	if b.debt < 0 {
+		b.debt = 0
+	}
+	b.mu.Unlock()
+}
+
+// withdraw returns true if a retry is allowed
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.debt+1 > retryBurst {
+		return false
+	}
+	b.debt++
+	return true
+}
+
+// isIdempotent returns true if sending req twice has the same effect as
+// sending it once
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = req.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// replayableBody buffers the body of an idempotent request so it can be sent
+// again. It returns false if the request can't be retried.
+func (u *upstreamListener) replayableBody(req *http.Request) ([]byte, bool) {
+	cfg := u.server.config.Retries
+	if cfg.Attempts <= 0 || !isIdempotent(req) {
+		return nil, false
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	// the client waits for a 100 Continue before sending the body
+	if req.Header.Get("Expect") != "" || req.ContentLength > cfg.MaxBufferedBody {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, cfg.MaxBufferedBody+1))
+	if err != nil || int64(len(body)) > cfg.MaxBufferedBody {
+		// too big (or broken), send what was read followed by the rest
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		return nil, false
+	}
+	req.Body = http.NoBody
+	return body, true
+}
+
+// send sends a copy of req, rewritten for d, over bs and reads the response.
+// A pooled stream which fails before the request could have been processed
+// is replaced once. On failure the stream is closed.
+func (u *upstreamListener) send(d *downstreamConnection, bs *backendStream, reused bool, req *http.Request, body []byte, conn net.Conn, info io.Writer) (*backendStream, *http.Request, *http.Response, error) {
+	out := u.prepare(d, req, body, conn)
+	res, err := u.roundTrip(bs, out, info)
+	// the downstream may have closed a pooled stream while it was idle, so
+	// try again on a new one if nothing has been sent yet
+	if err != nil && reused && (body != nil || out.Body == http.NoBody) {
+		bs.Close()
+		bs, _, err = u.getStream(d)
+		if err == nil {
+			out = u.prepare(d, req, body, conn)
+			res, err = u.roundTrip(bs, out, info)
+		}
+	}
+	u.observe(d, err == nil && res.StatusCode < 500)
+	if err != nil {
+		if bs != nil {
+			bs.Close()
+		}
+		return nil, out, nil, err
+	}
+	return bs, out, res, nil
+}
+
+// prepare copies req from conn for a downstream
+func (u *upstreamListener) prepare(d *downstreamConnection, req *http.Request, body []byte, conn net.Conn) *http.Request {
+	out := req.Clone(req.Context())
+	if body != nil {
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+	if out.Body == nil {
+		out.Body = http.NoBody
+	}
+	if rw := d.route.rewrite; rw != nil {
+		rw.request(out)
+	}
+	// streams are shared by clients so the client is identified per request.
+	// Clients can't claim to be someone else.
+	out.Header.Del(protocol.MetadataHeader)
+	if d.capabilities&protocol.CapabilityStreamMetadata != 0 {
+		out.Header.Set(protocol.MetadataHeader, protocol.EncodeStreamMetadata(streamMetadata(conn)))
+	}
+	return out
+}
+
+// retry releases a failed downstream and returns another one for req with a
+// stream reserved, or nil if the request shouldn't be retried
+func (u *upstreamListener) retry(d *downstreamConnection, req *http.Request, conn net.Conn, tried map[int64]bool) (*downstreamConnection, *backendStream, bool) {
+	d.release()
+	tried[d.id] = true
+	if len(tried) > u.server.config.Retries.Attempts || !u.retries.withdraw() {
+		return nil, nil, false
+	}
+	for {
+		d, _ := u.findDownstreamHTTP(req, conn, tried)
+		if d == nil {
+			return nil, nil, false
+		}
+		bs, reused, err := u.getStream(d)
+		if err != nil {
+			d.release()
+			u.removeDownstream(d)
+			continue
+		}
+		return d, bs, reused
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+// a rewrite is the compiled form of a rewrite definition
+type rewrite struct {
+	def        protocol.SocketHTTPRewriteDefinition
+	pathPrefix string
+	path       *regexp.Regexp
+}
+
+func newRewrite(def protocol.SocketHTTPRewriteDefinition, pathPrefix string) (*rewrite, error) {
+	rw := &rewrite{def: def, pathPrefix: pathPrefix}
+	if def.PathRegex != "" {
+		var err error
+		rw.path, err = regexp.Compile(def.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex: %v", err)
+		}
+	}
+	return rw, nil
+}
+
+// request rewrites a request before it's sent to the downstream
+func (rw *rewrite) request(req *http.Request) {
+	path := req.URL.Path
+	if rw.def.StripPrefix {
+		path = strings.TrimPrefix(path, rw.pathPrefix)
+	}
+	if rw.path != nil {
+		path = rw.path.ReplaceAllString(path, rw.def.PathReplacement)
+	}
+	path = rw.def.AddPrefix + path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if path != req.URL.Path {
+		req.URL.Path = path
+		req.URL.RawPath = ""
+	}
+
+	if rw.def.Host != "" {
+		req.Host = rw.def.Host
+	}
+	editHeader(req.Header, rw.def.RequestHeaders, rw.def.RemoveRequestHeaders)
+}
+
+// response rewrites the headers of a response from the downstream
+func (rw *rewrite) response(h http.Header) {
+	editHeader(h, rw.def.ResponseHeaders, rw.def.RemoveResponseHeaders)
+}
+
+func editHeader(h http.Header, set map[string]string, remove []string) {
+	for _, k := range remove {
+		h.Del(k)
+	}
+	for k, v := range set {
+		h.Set(k, v)
+	}
+}
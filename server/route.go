@@ -0,0 +1,209 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+// an httpRoute is the compiled form of an HTTP socket definition
+type httpRoute struct {
+	def protocol.SocketHTTPDefinition
+	// host is the lower case Host without the wildcard prefix
+	host     string
+	wildcard bool
+	suffix   string
+	methods  map[string]bool
+	path     *regexp.Regexp
+	rewrite  *rewrite
+	// errorPages are the route's own error pages
+	errorPages []errorPage
+	// key is the same for routes which match the same requests
+	key string
+}
+
+func newHTTPRoute(def protocol.SocketHTTPDefinition) (*httpRoute, error) {
+	r := &httpRoute{
+		def:    def,
+		host:   strings.ToLower(strings.TrimSuffix(def.Host, ".")),
+		suffix: strings.ToLower(strings.TrimSuffix(def.DomainSuffix, ".")),
+	}
+	if strings.HasPrefix(r.host, "*.") {
+		r.host = r.host[2:]
+		r.wildcard = true
+	}
+	if strings.Contains(r.host, "*") || (r.wildcard && r.host == "") {
+		return nil, fmt.Errorf("invalid host: %q", def.Host)
+	}
+
+	methods := make([]string, 0, len(def.Methods))
+	for _, m := range def.Methods {
+		m = strings.ToUpper(m)
+		if r.methods == nil {
+			r.methods = map[string]bool{}
+		}
+		if !r.methods[m] {
+			r.methods[m] = true
+			methods = append(methods, m)
+		}
+	}
+	sort.Strings(methods)
+
+	if def.PathRegex != "" {
+		var err error
+		r.path, err = regexp.Compile(def.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex: %v", err)
+		}
+	}
+
+	if def.Rewrite != nil {
+		var err error
+		r.rewrite, err = newRewrite(*def.Rewrite, def.PathPrefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	r.errorPages, err = compileErrorPages(def.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string, len(def.Headers))
+	for k, v := range def.Headers {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+	// fmt prints maps with sorted keys
+	r.key = fmt.Sprintf("%q %v %q %q %v %v %v %q",
+		r.host, r.wildcard, r.suffix, def.PathPrefix, methods, headers, def.Query, def.PathRegex)
+	return r, nil
+}
+
+// match returns true if req should be routed to the route
+func (r *httpRoute) match(req *http.Request) bool {
+	host := requestHost(req)
+	switch {
+	case r.wildcard:
+		if !strings.HasSuffix(host, "."+r.host) {
+			return false
+		}
+	case r.host != "":
+		if host != r.host {
+			return false
+		}
+	}
+	if r.suffix != "" && !hasDomainSuffix(host, r.suffix) {
+		return false
+	}
+
+	if !strings.HasPrefix(req.URL.Path, r.def.PathPrefix) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.methods != nil && !r.methods[req.Method] {
+		return false
+	}
+	for k, v := range r.def.Headers {
+		vs, ok := req.Header[http.CanonicalHeaderKey(k)]
+		if !ok || !contains(vs, v) {
+			return false
+		}
+	}
+	if len(r.def.Query) > 0 {
+		query := req.URL.Query()
+		for k, v := range r.def.Query {
+			vs, ok := query[k]
+			if !ok || !contains(vs, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// contains returns true if v is one of vs. An empty v only requires the key
+// to be present.
+func contains(vs []string, v string) bool {
+	if v == "" {
+		return true
+	}
+	for _, s := range vs {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// less returns true if r takes precedence over o. The most specific route
+// wins:
+//
+//  1. an exact host, then a wildcard host, then a domain suffix, then none,
+//     with longer hosts and suffixes first
+//  2. a path regex, then longer path prefixes
+//  3. more method, header and query predicates
+func (r *httpRoute) less(o *httpRoute) bool {
+	if a, b := r.hostRank(), o.hostRank(); a != b {
+		return a > b
+	}
+	if a, b := len(r.host)+len(r.suffix), len(o.host)+len(o.suffix); a != b {
+		return a > b
+	}
+	if a, b := r.path != nil, o.path != nil; a != b {
+		return a
+	}
+	if a, b := len(r.def.PathPrefix), len(o.def.PathPrefix); a != b {
+		return a > b
+	}
+	return r.predicates() > o.predicates()
+}
+
+func (r *httpRoute) hostRank() int {
+	switch {
+	case r.host != "" && !r.wildcard:
+		return 3
+	case r.wildcard:
+		return 2
+	case r.suffix != "":
+		return 1
+	}
+	return 0
+}
+
+func (r *httpRoute) predicates() int {
+	n := len(r.def.Headers) + len(r.def.Query)
+	if r.methods != nil {
+		n++
+	}
+	return n
+}
+
+// requestHost returns the lower case host of req without its port
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// hasDomainSuffix returns true if host is suffix or a subdomain of it. A
+// suffix starting with a dot only matches subdomains.
+func hasDomainSuffix(host, suffix string) bool {
+	if strings.HasPrefix(suffix, ".") {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/badgerodon/socketmaster/protocol"
+)
+
+func TestHTTPRouteMatch(t *testing.T) {
+	tests := []struct {
+		def    protocol.SocketHTTPDefinition
+		method string
+		url    string
+		header http.Header
+		match  bool
+	}{
+		{protocol.SocketHTTPDefinition{DomainSuffix: "example.com"}, "GET", "http://example.com:8080/", nil, true},
+		{protocol.SocketHTTPDefinition{DomainSuffix: "example.com"}, "GET", "http://www.Example.com/", nil, true},
+		{protocol.SocketHTTPDefinition{DomainSuffix: "example.com"}, "GET", "http://badexample.com/", nil, false},
+		{protocol.SocketHTTPDefinition{Host: "example.com"}, "GET", "http://example.com:8080/", nil, true},
+		{protocol.SocketHTTPDefinition{Host: "example.com"}, "GET", "http://www.example.com/", nil, false},
+		{protocol.SocketHTTPDefinition{Host: "*.example.com"}, "GET", "http://www.example.com/", nil, true},
+		{protocol.SocketHTTPDefinition{Host: "*.example.com"}, "GET", "http://example.com/", nil, false},
+		{protocol.SocketHTTPDefinition{Methods: []string{"post"}}, "POST", "http://example.com/", nil, true},
+		{protocol.SocketHTTPDefinition{Methods: []string{"post"}}, "GET", "http://example.com/", nil, false},
+		{protocol.SocketHTTPDefinition{Headers: map[string]string{"x-canary": ""}}, "GET", "http://example.com/", http.Header{"X-Canary": {"1"}}, true},
+		{protocol.SocketHTTPDefinition{Headers: map[string]string{"x-canary": "1"}}, "GET", "http://example.com/", http.Header{"X-Canary": {"2"}}, false},
+		{protocol.SocketHTTPDefinition{Query: map[string]string{"v": "2"}}, "GET", "http://example.com/?v=2", nil, true},
+		{protocol.SocketHTTPDefinition{Query: map[string]string{"v": "2"}}, "GET", "http://example.com/", nil, false},
+		{protocol.SocketHTTPDefinition{PathRegex: `^/users/[0-9]+$`}, "GET", "http://example.com/users/12", nil, true},
+		{protocol.SocketHTTPDefinition{PathRegex: `^/users/[0-9]+$`}, "GET", "http://example.com/users/me", nil, false},
+	}
+	for _, test := range tests {
+		r, err := newHTTPRoute(test.def)
+		if err != nil {
+			t.Errorf("error compiling %+v: %v", test.def, err)
+			continue
+		}
+		req := httptest.NewRequest(test.method, test.url, nil)
+		for k, vs := range test.header {
+			req.Header[k] = vs
+		}
+		if r.match(req) != test.match {
+			t.Errorf("expected match of %+v with %s %s to be %v", test.def, test.method, test.url, test.match)
+		}
+	}
+
+	for _, def := range []protocol.SocketHTTPDefinition{
+		{Host: "a.*.com"},
+		{Host: "*."},
+		{PathRegex: "("},
+	} {
+		_, err := newHTTPRoute(def)
+		if err == nil {
+			t.Errorf("expected %+v to be invalid", def)
+		}
+	}
+}
+
+func TestHTTPRoutePrecedence(t *testing.T) {
+	// most specific first
+	defs := []protocol.SocketHTTPDefinition{
+		{Host: "www.example.com"},
+		{Host: "*.example.com"},
+		{DomainSuffix: "www.example.com"},
+		{DomainSuffix: "example.com", PathRegex: "^/a"},
+		{DomainSuffix: "example.com", PathPrefix: "/a/"},
+		{DomainSuffix: "example.com", Methods: []string{"GET"}},
+		{DomainSuffix: "example.com"},
+		{},
+	}
+	var routes []*httpRoute
+	for i := len(defs) - 1; i >= 0; i-- {
+		r, err := newHTTPRoute(defs[i])
+		if err != nil {
+			t.Errorf("error compiling %+v: %v", defs[i], err)
+			return
+		}
+		routes = append(routes, r)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].less(routes[j])
+	})
+	for i, r := range routes {
+		if r.def.Host != defs[i].Host ||
+			r.def.DomainSuffix != defs[i].DomainSuffix || r.def.PathPrefix != defs[i].PathPrefix ||
+			r.def.PathRegex != defs[i].PathRegex || len(r.def.Methods) != len(defs[i].Methods) {
+			t.Errorf("expected %+v at %d got %+v", defs[i], i, r.def)
+		}
+	}
+}
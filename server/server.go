@@ -1,9 +1,12 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/badgerodon/socketmaster/protocol"
@@ -17,6 +20,9 @@ type (
 		nextID   int64
 		config   *Config
 		mu       sync.Mutex
+
+		// errorPages are the compiled global error pages
+		errorPages []errorPage
 	}
 )
 
@@ -27,10 +33,19 @@ func New(li net.Listener, cfg *Config) *Server {
 		nextID:   1,
 		config:   cfg,
 	}
+	var err error
+	s.errorPages, err = compileErrorPages(cfg.ErrorPages)
+	if err != nil {
+		cfg.Logger.Printf("ignoring error pages: %v\n", err)
+	}
 	return s
 }
 
 func (s *Server) handleDownstreamConnection(conn net.Conn) {
+	if t := s.config.HandshakeTimeout; t > 0 {
+		conn.SetDeadline(time.Now().Add(t))
+	}
+
 	// a downstream connection starts with a handshake specifying what socket to
 	// listen on
 	req, err := protocol.ReadHandshakeRequest(conn)
@@ -39,9 +54,72 @@ func (s *Server) handleDownstreamConnection(conn net.Conn) {
 		conn.Close()
 		return
 	}
-	protocol.WriteHandshakeResponse(conn, protocol.HandshakeResponse{
-		Status: "OK",
-	})
+	// identify local processes registering over a unix socket so the
+	// authenticator can decide what they may register
+	if _, ok := conn.(*net.UnixConn); ok {
+		cred, err := PeerCredentials(conn)
+		if err == nil {
+			s.config.Logger.Printf("downstream registration from pid=%d uid=%d gid=%d\n", cred.PID, cred.UID, cred.GID)
+			req.Peer = cred
+		}
+	}
+
+	res := protocol.HandshakeResponse{
+		Version:      req.Version,
+		Capabilities: req.Capabilities & protocol.SupportedCapabilities,
+	}
+	if res.Version > protocol.Version {
+		res.Version = protocol.Version
+	}
+
+	if s.config.Authenticator != nil {
+		err = s.config.Authenticator.Authenticate(conn, req)
+		if err != nil {
+			s.config.Logger.Printf("rejected downstream %v: %v\n", conn.RemoteAddr(), err)
+			s.reject(conn, res, err)
+			return
+		}
+	}
+
+	var route *httpRoute
+	if req.SocketDefinition.HTTP != nil {
+		route, err = newHTTPRoute(*req.SocketDefinition.HTTP)
+		if err != nil {
+			s.config.Logger.Printf("rejected downstream %v: %v\n", conn.RemoteAddr(), err)
+			s.reject(conn, res, &protocol.HandshakeError{
+				Code:    protocol.CodeInvalidDefinition,
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// bind the upstream listener before replying so failures can be reported
+	// back to the client
+	upstream, err := s.getUpstream(req.SocketDefinition)
+	if err != nil {
+		s.config.Logger.Printf("failed to create upstream connection: %v\n", err)
+		s.reject(conn, res, err)
+		return
+	}
+
+	res.Status = "OK"
+	res.Code = protocol.CodeOK
+	res.Address = upstream.address
+	res.Port = upstream.port
+	if addr, ok := upstream.listener.Addr().(*net.TCPAddr); ok {
+		res.Address = addr.IP.String()
+	}
+	err = protocol.WriteHandshakeResponse(conn, res)
+	if err != nil {
+		s.config.Logger.Printf("error writing response: %v", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
 
 	// establish a multiplexed session over the connection
 	session, err := yamux.Client(conn, yamux.DefaultConfig())
@@ -54,61 +132,174 @@ func (s *Server) handleDownstreamConnection(conn net.Conn) {
 	downstream := &downstreamConnection{
 		id:               s.nextID,
 		session:          session,
+		version:          res.Version,
+		capabilities:     res.Capabilities,
 		socketDefinition: req.SocketDefinition,
+		route:            route,
+		currentWeight:    -1,
 	}
 	s.nextID++
 
-	var upstream *upstreamListener
-	for _, u := range s.upstream {
-		if req.SocketDefinition.Address == u.address &&
-			req.SocketDefinition.Port == u.port {
-			upstream = u
-		}
+	upstream.mu.Lock()
+	upstream.downstream[downstream.id] = downstream
+	if t := downstream.socketDefinition.MissingRouteTimeout; t > 0 {
+		upstream.setMissingRouteTimeout(downstream.route, t)
+	}
+	upstream.mu.Unlock()
+	upstream.update()
+
+	if downstream.capabilities&protocol.CapabilityControl != 0 {
+		go upstream.serveControl(downstream)
+	}
+	if downstream.socketDefinition.HealthCheck != nil {
+		go upstream.healthCheck(downstream)
 	}
+}
 
-	if upstream == nil {
-		s.config.Logger.Printf("opening new upstream listener: %v:%v", req.SocketDefinition.Address, req.SocketDefinition.Port)
-		li, err := net.Listen("tcp", fmt.Sprint(req.SocketDefinition.Address, ":", req.SocketDefinition.Port))
+// getUpstream validates a socket definition and returns the upstream listener
+// it should be attached to, binding a new one if necessary
+func (s *Server) getUpstream(def protocol.SocketDefinition) (*upstreamListener, error) {
+	if def.TLS != nil {
+		_, err := tls.X509KeyPair([]byte(def.TLS.Cert), []byte(def.TLS.Key))
 		if err != nil {
-			s.config.Logger.Printf("failed to create upstream connection: %v\n", err)
-			session.Close()
-			return
+			return nil, &protocol.HandshakeError{
+				Code:    protocol.CodeInvalidCert,
+				Message: err.Error(),
+			}
 		}
+	}
 
-		upstream = &upstreamListener{
-			server:     s,
-			id:         s.nextID,
-			listener:   li,
-			downstream: map[int64]*downstreamConnection{},
-			address:    req.SocketDefinition.Address,
-			port:       req.SocketDefinition.Port,
+	if pp := def.ProxyProtocol; pp != nil && pp.Send != 0 && pp.Send != 1 && pp.Send != 2 {
+		return nil, &protocol.HandshakeError{
+			Code:    protocol.CodeInvalidDefinition,
+			Message: fmt.Sprintf("unsupported proxy protocol version: %d", pp.Send),
 		}
-		s.nextID++
-		s.upstream[upstream.id] = upstream
-
-		go func() {
-			for {
-				conn, err := li.Accept()
-				if err != nil {
-					// if this is a temporary error we will try again
-					if ne, ok := err.(net.Error); ok && ne.Temporary() {
-						time.Sleep(1 * time.Second)
-						continue
-					}
-					break
+	}
+	if b := def.Balance; b != nil {
+		_, err := newBalancer(b.Strategy)
+		if err == nil && b.Weight != nil {
+			err = checkWeight(b.Strategy, *b.Weight)
+		}
+		if err != nil {
+			return nil, &protocol.HandshakeError{
+				Code:    protocol.CodeInvalidDefinition,
+				Message: err.Error(),
+			}
+		}
+	}
+	if hc := def.HealthCheck; hc != nil {
+		err := validateHealthCheck(hc)
+		if err != nil {
+			return nil, &protocol.HandshakeError{
+				Code:    protocol.CodeInvalidDefinition,
+				Message: err.Error(),
+			}
+		}
+	}
+	if def.MissingRouteTimeout < 0 {
+		return nil, &protocol.HandshakeError{
+			Code:    protocol.CodeInvalidDefinition,
+			Message: fmt.Sprintf("invalid missing route timeout: %v", def.MissingRouteTimeout),
+		}
+	}
+	acceptProxyProtocol := def.ProxyProtocol != nil && def.ProxyProtocol.Accept
+
+	for _, u := range s.upstream {
+		if def.Address == u.address && def.Port == u.port {
+			if acceptProxyProtocol != u.acceptProxyProtocol {
+				return nil, &protocol.HandshakeError{
+					Code:    protocol.CodeConflictingRoute,
+					Message: fmt.Sprintf("%v:%v is already bound with a different proxy protocol setting", u.address, u.port),
+				}
+			}
+			// HTTP and plain TCP can't share a port. Unhealthy downstreams
+			// count too.
+			u.mu.RLock()
+			conflict := false
+			for _, d := range u.downstream {
+				if (d.socketDefinition.HTTP == nil) != (def.HTTP == nil) {
+					conflict = true
 				}
+			}
+			u.mu.RUnlock()
+			if conflict {
+				return nil, &protocol.HandshakeError{
+					Code:    protocol.CodeConflictingRoute,
+					Message: fmt.Sprintf("%v:%v is already bound with a different protocol", u.address, u.port),
+				}
+			}
+			return u, nil
+		}
+	}
+
+	s.config.Logger.Printf("opening new upstream listener: %v:%v", def.Address, def.Port)
+	li, err := net.Listen("tcp", fmt.Sprint(def.Address, ":", def.Port))
+	if err != nil {
+		return nil, err
+	}
 
-				go upstream.route(conn)
+	upstream := &upstreamListener{
+		server:         s,
+		id:             s.nextID,
+		listener:       li,
+		downstream:     map[int64]*downstreamConnection{},
+		address:        def.Address,
+		port:           li.Addr().(*net.TCPAddr).Port,
+		lastUpdateTime: time.Now(),
+
+		acceptProxyProtocol: acceptProxyProtocol,
+		balancers:           map[string]balancer{},
+		changed:             make(chan struct{}),
+
+		missingRouteTimeouts: map[string]routeTimeout{},
+	}
+	s.nextID++
+	s.upstream[upstream.id] = upstream
+
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				// if this is a temporary error we will try again
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					time.Sleep(1 * time.Second)
+					continue
+				}
+				break
 			}
-			upstream.close()
-			s.mu.Lock()
-			delete(s.upstream, upstream.id)
-			s.mu.Unlock()
-		}()
+
+			go upstream.route(conn)
+		}
+		upstream.close()
+		s.mu.Lock()
+		delete(s.upstream, upstream.id)
+		s.mu.Unlock()
+	}()
+
+	return upstream, nil
+}
+
+// reject reports a failed handshake to the client and closes the connection
+func (s *Server) reject(conn net.Conn, res protocol.HandshakeResponse, err error) {
+	herr, ok := err.(*protocol.HandshakeError)
+	if !ok {
+		herr = &protocol.HandshakeError{
+			Code:    protocol.CodeUnknown,
+			Message: err.Error(),
+		}
+		switch {
+		case errors.Is(err, syscall.EADDRINUSE):
+			herr.Code = protocol.CodePortInUse
+		case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+			herr.Code = protocol.CodePermissionDenied
+		}
 	}
 
-	upstream.downstream[downstream.id] = downstream
-	upstream.update()
+	res.Status = herr.Error()
+	res.Code = herr.Code
+	res.Message = herr.Message
+	protocol.WriteHandshakeResponse(conn, res)
+	conn.Close()
 }
 
 func (s *Server) Serve() error {
@@ -125,6 +316,7 @@ func (s *Server) Serve() error {
 						delete(u.downstream, d.id)
 						changed = true
 					}
+					d.pool.prune(s.config.IdleStreamTimeout)
 				}
 				u.mu.Unlock()
 				if changed {
@@ -163,9 +355,9 @@ func (s *Server) Serve() error {
 			return err
 		}
 
-		s.mu.Lock()
-		s.handleDownstreamConnection(conn)
-		s.mu.Unlock()
+		// the handshake is read (and authenticated) without holding the lock
+		// so slow connections don't hold up others
+		go s.handleDownstreamConnection(conn)
 	}
 }
 
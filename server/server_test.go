@@ -1,12 +1,21 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -276,3 +285,1651 @@ func TestTLS(t *testing.T) {
 		return
 	}
 }
+
+func TestClientCertRequest(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	for _, name := range []string{"a.test", "b.test"} {
+		cert, err := newTestCert("", name)
+		if err != nil {
+			t.Errorf("error creating certificate: %v", err)
+			return
+		}
+		cert.RequestClientCert = name == "a.test"
+		c, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+			Address: "127.0.0.1",
+			Port:    8999,
+			TLS:     cert,
+		})
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		defer c.Close()
+	}
+
+	// only the certificate which opted in asks for client certificates
+	for name, expected := range map[string]bool{"a.test": true, "b.test": false} {
+		requested := false
+		conn, err := tls.Dial("tcp", "127.0.0.1:8999", &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				requested = true
+				return new(tls.Certificate), nil
+			},
+		})
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		conn.Close()
+		if requested != expected {
+			t.Errorf("expected a client certificate request for %v to be %v", name, expected)
+		}
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	defer taken.Close()
+
+	_, err = client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    taken.Addr().(*net.TCPAddr).Port,
+	})
+	if !errors.Is(err, protocol.ErrPortInUse) {
+		t.Errorf("expected %v got %v", protocol.ErrPortInUse, err)
+	}
+
+	_, err = client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		TLS: &protocol.SocketTLSDefinition{
+			Cert: tlsCert,
+			Key:  "invalid",
+		},
+	})
+	if !errors.Is(err, protocol.ErrInvalidCert) {
+		t.Errorf("expected %v got %v", protocol.ErrInvalidCert, err)
+	}
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	_, err = client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{},
+	})
+	if !errors.Is(err, protocol.ErrConflictingRoute) {
+		t.Errorf("expected %v got %v", protocol.ErrConflictingRoute, err)
+	}
+}
+
+func TestSlowHandshake(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	cfg := DefaultConfig()
+	cfg.HandshakeTimeout = time.Millisecond * 200
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	// a connection which never sends its handshake doesn't block others
+	idle, err := net.Dial("tcp", li1.Addr().String())
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer idle.Close()
+
+	c := client.New(li1.Addr().String())
+	c.HandshakeTimeout = time.Millisecond * 100
+	c1, err := c.Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	c1.Close()
+
+	// and is closed once the handshake timeout passes
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("expected the idle connection to be closed got %v", err)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	secret := []byte("secret")
+	cfg := DefaultConfig()
+	cfg.Authenticator = &HMACAuthenticator{
+		Secret: secret,
+		Allowances: map[string]Allowance{
+			"svc": {
+				Ports:        []int{8999},
+				PathPrefixes: []string{"/svc/"},
+			},
+		},
+	}
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	listen := func(token string, port int, pathPrefix string) error {
+		c := client.New(li1.Addr().String())
+		c.Token = token
+		li, err := c.Listen(protocol.SocketDefinition{
+			Address: "127.0.0.1",
+			Port:    port,
+			HTTP: &protocol.SocketHTTPDefinition{
+				PathPrefix: pathPrefix,
+			},
+		})
+		if err == nil {
+			li.Close()
+		}
+		return err
+	}
+
+	token := protocol.HMACToken(secret, "svc")
+	if err := listen(token, 8999, "/svc/a/"); err != nil {
+		t.Errorf("expected no error got %v", err)
+	}
+	if err := listen("", 8999, "/svc/a/"); !errors.Is(err, protocol.ErrPermissionDenied) {
+		t.Errorf("expected %v got %v", protocol.ErrPermissionDenied, err)
+	}
+	if err := listen(protocol.HMACToken([]byte("wrong"), "svc"), 8999, "/svc/a/"); !errors.Is(err, protocol.ErrPermissionDenied) {
+		t.Errorf("expected %v got %v", protocol.ErrPermissionDenied, err)
+	}
+	if err := listen(token, 8998, "/svc/a/"); !errors.Is(err, protocol.ErrPermissionDenied) {
+		t.Errorf("expected %v got %v", protocol.ErrPermissionDenied, err)
+	}
+	if err := listen(token, 8999, "/other/"); !errors.Is(err, protocol.ErrPermissionDenied) {
+		t.Errorf("expected %v got %v", protocol.ErrPermissionDenied, err)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socketmaster.sock")
+	li1, err := net.Listen("unix", path)
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	creds := make(chan *Credentials, 1)
+	cfg := DefaultConfig()
+	cfg.Authenticator = AuthenticatorFunc(func(conn net.Conn, req protocol.HandshakeRequest) error {
+		if req.Peer == nil {
+			return errors.New("unknown peer")
+		}
+		creds <- req.Peer
+		return nil
+	})
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New("unix://" + path).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+	})
+	if runtime.GOOS != "linux" {
+		if !errors.Is(err, protocol.ErrUnknown) {
+			t.Errorf("expected %v got %v", protocol.ErrUnknown, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	cred := <-creds
+	if cred.PID != os.Getpid() || cred.UID != os.Getuid() {
+		t.Errorf("expected pid=%v uid=%v got pid=%v uid=%v", os.Getpid(), os.Getuid(), cred.PID, cred.UID)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	addr := li1.Addr().String()
+	s1 := New(li1, DefaultConfig())
+	go s1.Serve()
+
+	c1, err := client.New(addr).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- http.Serve(c1, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			io.WriteString(res, "a")
+		}))
+	}()
+
+	str := httpGet("http://127.0.0.1:8999/")
+	if str != "a" {
+		t.Error("expected `a` got", str)
+		return
+	}
+
+	// restart the socket master
+	li1.Close()
+	s1.Close()
+	li2, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	defer li2.Close()
+	s2 := New(li2, DefaultConfig())
+	defer s2.Close()
+	go s2.Serve()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		str = httpGet("http://127.0.0.1:8999/")
+		if str == "a" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Error("expected `a` got", str)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	c1.Close()
+	if err := <-served; err != client.ErrClosed {
+		t.Errorf("expected %v got %v", client.ErrClosed, err)
+	}
+}
+
+func TestListenContext(t *testing.T) {
+	// a socket master that never answers the handshake
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	defer hung.Close()
+	go func() {
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.New(hung.Addr().String()).ListenContext(ctx, protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v got %v", context.DeadlineExceeded, err)
+	}
+
+	c := client.New(hung.Addr().String())
+	c.HandshakeTimeout = 100 * time.Millisecond
+	_, err = c.Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+	})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expected a timeout got %v", err)
+	}
+
+	// cancelling the context unblocks Accept
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	c1, err := client.New(li1.Addr().String()).ListenContext(ctx, protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := c1.Accept()
+		accepted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err = <-accepted:
+		if err != context.Canceled {
+			t.Errorf("expected %v got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected Accept to return after the context was cancelled")
+	}
+}
+
+func TestAddr(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    0,
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	addr := c1.Addr().(*net.TCPAddr)
+	if addr.Port == 0 || addr.IP.String() != "127.0.0.1" {
+		t.Errorf("expected the address the server bound got %v", addr)
+		return
+	}
+
+	c2, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Errorf("failed to connect: %v", err)
+		return
+	}
+	defer c2.Close()
+
+	conn, err := c1.Accept()
+	if err != nil {
+		t.Errorf("error accepting: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if conn.RemoteAddr().String() != c2.LocalAddr().String() {
+		t.Errorf("expected `%v` got `%v`", c2.LocalAddr(), conn.RemoteAddr())
+	}
+
+	// a restarted socket master binds the same port again
+	li1.Close()
+	s.Close()
+	li2, err := net.Listen("tcp", li1.Addr().String())
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	defer li2.Close()
+	s2 := New(li2, DefaultConfig())
+	defer s2.Close()
+	go s2.Serve()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := c1.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c3, err := net.Dial("tcp", addr.String())
+		if err == nil {
+			defer c3.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("expected %v to be bound again: %v", addr, err)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Errorf("expected a connection")
+	}
+	if c1.Addr().String() != addr.String() {
+		t.Errorf("expected `%v` got `%v`", addr, c1.Addr())
+	}
+}
+
+func TestStreamMetadata(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		TLS: &protocol.SocketTLSDefinition{
+			Cert: tlsCert,
+			Key:  tlsKey,
+		},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	go func() {
+		c2, err := tls.Dial("tcp", "127.0.0.1:8999", &tls.Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Errorf("failed to connect: %v", err)
+			return
+		}
+		io.WriteString(c2, "Hello World")
+		c2.Close()
+	}()
+
+	conn, err := c1.Accept()
+	if err != nil {
+		t.Errorf("error accepting: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	md := conn.(*client.Conn).Metadata()
+	if md.LocalPort != 8999 {
+		t.Errorf("expected local port 8999 got %v", md.LocalPort)
+	}
+	if md.TLS == nil || md.TLS.ServerName != "example.com" {
+		t.Errorf("expected server name `example.com` got %v", md.TLS)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		ProxyProtocol: &protocol.SocketProxyProtocolDefinition{
+			Accept: true,
+			Send:   2,
+		},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	go func() {
+		c2, err := net.Dial("tcp", "127.0.0.1:8999")
+		if err != nil {
+			t.Errorf("failed to connect: %v", err)
+			return
+		}
+		io.WriteString(c2, "PROXY TCP4 1.2.3.4 127.0.0.1 5678 8999\r\nHello World")
+		c2.Close()
+	}()
+
+	conn, err := c1.Accept()
+	if err != nil {
+		t.Errorf("error accepting: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if conn.RemoteAddr().String() != "1.2.3.4:5678" {
+		t.Errorf("expected `1.2.3.4:5678` got `%v`", conn.RemoteAddr())
+	}
+	src, _, err := readProxyHeader(conn)
+	if err != nil {
+		t.Errorf("error reading proxy header: %v", err)
+		return
+	}
+	if src.String() != "1.2.3.4:5678" {
+		t.Errorf("expected `1.2.3.4:5678` got `%v`", src)
+	}
+	bs, _ := ioutil.ReadAll(conn)
+	if string(bs) != "Hello World" {
+		t.Errorf("expected `Hello World` got `%s`", bs)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	// an echo server reached via an upgrade
+	go http.Serve(c1, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		conn, rw, err := res.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+
+	c2, err := net.Dial("tcp", "127.0.0.1:8999")
+	if err != nil {
+		t.Errorf("failed to connect: %v", err)
+		return
+	}
+	defer c2.Close()
+	io.WriteString(c2, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	br := bufio.NewReader(c2)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Errorf("error reading response: %v", err)
+		return
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("expected 101 got %v", res.Status)
+		return
+	}
+
+	for _, msg := range []string{"Hello", "World"} {
+		io.WriteString(c2, msg)
+		buf := make([]byte, len(msg))
+		c2.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(br, buf)
+		if err != nil || string(buf) != msg {
+			t.Errorf("expected `%v` got `%s` (%v)", msg, buf, err)
+			return
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	cfg := DefaultConfig()
+	cfg.HTTP2Cleartext = true
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	for _, port := range []int{8999, 8998} {
+		for _, name := range []string{"a", "b"} {
+			def := protocol.SocketDefinition{
+				Address: "127.0.0.1",
+				Port:    port,
+				HTTP: &protocol.SocketHTTPDefinition{
+					PathPrefix: "/" + name + "/",
+				},
+			}
+			if port == 8999 {
+				def.TLS = &protocol.SocketTLSDefinition{
+					Cert: tlsCert,
+					Key:  tlsKey,
+				}
+			}
+			c, err := client.New(li1.Addr().String()).Listen(def)
+			if err != nil {
+				t.Errorf("error dialing: %v", err)
+				return
+			}
+			defer c.Close()
+
+			name := name
+			go http.Serve(c, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				io.WriteString(res, name)
+			}))
+		}
+	}
+
+	tlsClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	h2cProtocols := new(http.Protocols)
+	h2cProtocols.SetUnencryptedHTTP2(true)
+	h2cClient := &http.Client{Transport: &http.Transport{
+		Protocols: h2cProtocols,
+	}}
+
+	for _, test := range []struct {
+		client *http.Client
+		url    string
+	}{
+		{tlsClient, "https://127.0.0.1:8999"},
+		{h2cClient, "http://127.0.0.1:8998"},
+	} {
+		// both requests share a connection but go to different downstreams
+		for _, name := range []string{"a", "b"} {
+			res, err := test.client.Get(test.url + "/" + name + "/")
+			if err != nil {
+				t.Errorf("error making request: %v", err)
+				return
+			}
+			bs, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.ProtoMajor != 2 {
+				t.Errorf("expected HTTP/2 got %v", res.Proto)
+			}
+			if string(bs) != name {
+				t.Errorf("expected `%v` got `%s`", name, bs)
+			}
+		}
+	}
+}
+
+func TestHTTPStreaming(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	next := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", func(res http.ResponseWriter, req *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, req.Body)
+		io.WriteString(res, strconv.FormatInt(n, 10))
+	})
+	mux.HandleFunc("/events", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(res, "data: 1\n\n")
+		res.(http.Flusher).Flush()
+		<-next
+		io.WriteString(res, "data: 2\n\n")
+	})
+	mux.HandleFunc("/echo", func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, req.URL.Query().Get("v"))
+	})
+	go http.Serve(c1, mux)
+
+	hc := &http.Client{Transport: &http.Transport{}}
+	defer hc.CloseIdleConnections()
+
+	// large uploads are streamed through
+	sz := 8 << 20
+	res, err := hc.Post("http://127.0.0.1:8999/upload", "application/octet-stream",
+		io.LimitReader(zeroReader{}, int64(sz)))
+	if err != nil {
+		t.Errorf("error uploading: %v", err)
+		return
+	}
+	bs, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(bs) != strconv.Itoa(sz) {
+		t.Errorf("expected `%v` got `%s`", sz, bs)
+	}
+
+	// server-sent events arrive as they're sent
+	res, err = hc.Get("http://127.0.0.1:8999/events")
+	if err != nil {
+		t.Errorf("error connecting to event stream: %v", err)
+		return
+	}
+	br := bufio.NewReader(res.Body)
+	line, err := br.ReadString('\n')
+	if line != "data: 1\n" {
+		t.Errorf("expected the first event before the second was sent got `%v` (%v)", line, err)
+	}
+	close(next)
+	bs, _ = ioutil.ReadAll(br)
+	res.Body.Close()
+	if string(bs) != "\ndata: 2\n\n" {
+		t.Errorf("expected the second event got `%s`", bs)
+	}
+
+	// pipelined requests
+	c2, err := net.Dial("tcp", "127.0.0.1:8999")
+	if err != nil {
+		t.Errorf("failed to connect: %v", err)
+		return
+	}
+	defer c2.Close()
+	io.WriteString(c2, "GET /echo?v=a HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /echo?v=b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	br = bufio.NewReader(c2)
+	for _, e := range []string{"a", "b"} {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Errorf("error reading response: %v", err)
+			return
+		}
+		bs, _ := ioutil.ReadAll(res.Body)
+		if string(bs) != e {
+			t.Errorf("expected `%v` got `%s`", e, bs)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestStreamPool(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	var streams int32
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			md, ok := client.RequestMetadata(req)
+			if !ok {
+				http.Error(res, "missing metadata", http.StatusBadRequest)
+				return
+			}
+			io.WriteString(res, net.JoinHostPort(md.RemoteIP, strconv.Itoa(md.RemotePort)))
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&streams, 1)
+			}
+		},
+	}
+	go srv.Serve(c1)
+
+	// requests from every connection reuse the idle stream, and each request
+	// identifies the connection it came from
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:8999")
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for j := 0; j < 3; j++ {
+			req, _ := http.NewRequest("GET", "http://127.0.0.1:8999/", nil)
+			// clients can't claim another identity
+			req.Header.Set(protocol.MetadataHeader, protocol.EncodeStreamMetadata(protocol.StreamMetadata{RemoteIP: "10.0.0.1"}))
+			req.Write(conn)
+			res, err := http.ReadResponse(reader, req)
+			if err != nil {
+				t.Errorf("error reading response: %v", err)
+				return
+			}
+			bs, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if string(bs) != conn.LocalAddr().String() {
+				t.Errorf("expected `%v` got `%s`", conn.LocalAddr(), bs)
+			}
+		}
+	}
+	if n := atomic.LoadInt32(&streams); n != 1 {
+		t.Errorf("expected requests to reuse the stream got %v streams", n)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	var counts [2]int32
+	for i := range counts {
+		i := i
+		c, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+			Address: "127.0.0.1",
+			Port:    8999,
+			HTTP:    &protocol.SocketHTTPDefinition{},
+			Balance: &protocol.SocketBalanceDefinition{
+				Strategy: protocol.BalanceRoundRobin,
+			},
+		})
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		defer c.Close()
+		go http.Serve(c, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&counts[i], 1)
+			io.WriteString(res, "a")
+		}))
+	}
+
+	for i := 0; i < 6; i++ {
+		str := httpGet("http://127.0.0.1:8999/")
+		if str != "a" {
+			t.Error("expected `a` got", str)
+			return
+		}
+	}
+	if a, b := atomic.LoadInt32(&counts[0]), atomic.LoadInt32(&counts[1]); a != 3 || b != 3 {
+		t.Errorf("expected requests to alternate got %v and %v", a, b)
+	}
+
+	// unknown strategies are rejected
+	_, err = client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{},
+		Balance: &protocol.SocketBalanceDefinition{
+			Strategy: "fastest",
+		},
+	})
+	if !errors.Is(err, protocol.ErrInvalidDefinition) {
+		t.Errorf("expected %v got %v", protocol.ErrInvalidDefinition, err)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	// weights this lopsided make the split deterministic
+	heavy := 1000000000
+
+	var listeners []*client.Listener
+	for i, balance := range []*protocol.SocketBalanceDefinition{nil, {Weight: &heavy}} {
+		c, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+			Address: "127.0.0.1",
+			Port:    8999,
+			HTTP:    &protocol.SocketHTTPDefinition{},
+			Balance: balance,
+		})
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		defer c.Close()
+		listeners = append(listeners, c)
+		str := strconv.Itoa(i)
+		go http.Serve(c, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			io.WriteString(res, str)
+		}))
+	}
+
+	for i := 0; i < 10; i++ {
+		str := httpGet("http://127.0.0.1:8999/")
+		if str != "1" {
+			t.Error("expected `1` got", str)
+			return
+		}
+	}
+
+	// shift the traffic back without registering again
+	for i, w := range []int{heavy, 1} {
+		err = listeners[i].SetWeight(w)
+		if err != nil {
+			t.Errorf("error setting weight: %v", err)
+			return
+		}
+	}
+	for i := 0; i < 10; i++ {
+		str := httpGet("http://127.0.0.1:8999/")
+		if str != "0" {
+			t.Error("expected `0` got", str)
+			return
+		}
+	}
+
+	// a weight of 0 stops the traffic
+	err = listeners[0].SetWeight(0)
+	if err != nil {
+		t.Errorf("error setting weight: %v", err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		str := httpGet("http://127.0.0.1:8999/")
+		if str != "1" {
+			t.Error("expected `1` got", str)
+			return
+		}
+	}
+
+	// strategies which ignore weights reject them
+	c3, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8998,
+		Balance: &protocol.SocketBalanceDefinition{Strategy: protocol.BalanceRoundRobin},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c3.Close()
+	err = c3.SetWeight(5)
+	if !errors.Is(err, protocol.ErrInvalidDefinition) {
+		t.Errorf("expected %v got %v", protocol.ErrInvalidDefinition, err)
+	}
+
+	// and so does registering with both
+	weight := 5
+	_, err = client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8997,
+		Balance: &protocol.SocketBalanceDefinition{
+			Strategy: protocol.BalanceRoundRobin,
+			Weight:   &weight,
+		},
+	})
+	if !errors.Is(err, protocol.ErrInvalidDefinition) {
+		t.Errorf("expected %v got %v", protocol.ErrInvalidDefinition, err)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP: &protocol.SocketHTTPDefinition{
+			PathPrefix: "/api/",
+			Rewrite: &protocol.SocketHTTPRewriteDefinition{
+				StripPrefix:           true,
+				PathRegex:             `^users/([0-9]+)$`,
+				PathReplacement:       "user/$1",
+				AddPrefix:             "/v2/",
+				Host:                  "backend.internal",
+				RequestHeaders:        map[string]string{"X-Route": "api"},
+				RemoveRequestHeaders:  []string{"X-Secret"},
+				ResponseHeaders:       map[string]string{"X-Served-By": "socketmaster"},
+				RemoveResponseHeaders: []string{"Server"},
+			},
+		},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+	go http.Serve(c1, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Server", "backend")
+		io.WriteString(res, req.URL.Path+" "+req.Host+" "+req.Header.Get("X-Route")+" "+req.Header.Get("X-Secret"))
+	}))
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:8999/api/users/12", nil)
+	req.Header.Set("X-Secret", "hunter2")
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Errorf("error requesting: %v", err)
+		return
+	}
+	defer res.Body.Close()
+	bs, _ := ioutil.ReadAll(res.Body)
+	if str := string(bs); str != "/v2/user/12 backend.internal api " {
+		t.Errorf("expected `/v2/user/12 backend.internal api ` got `%v`", str)
+	}
+	if res.Header.Get("X-Served-By") != "socketmaster" || res.Header.Get("Server") != "" {
+		t.Errorf("expected response headers to be rewritten got %v", res.Header)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	var sick int32
+	for _, name := range []string{"a", "b"} {
+		name := name
+		c, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+			Address: "127.0.0.1",
+			Port:    8999,
+			HTTP:    &protocol.SocketHTTPDefinition{},
+			Balance: &protocol.SocketBalanceDefinition{
+				Strategy: protocol.BalanceRoundRobin,
+			},
+			HealthCheck: &protocol.SocketHealthCheckDefinition{
+				Type:               protocol.HealthCheckHTTP,
+				Path:               "/health",
+				Interval:           time.Millisecond * 20,
+				Timeout:            time.Second,
+				UnhealthyThreshold: 1,
+				HealthyThreshold:   1,
+			},
+		})
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		defer c.Close()
+		go http.Serve(c, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/health" && name == "b" && atomic.LoadInt32(&sick) == 1 {
+				res.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			io.WriteString(res, name)
+		}))
+	}
+
+	get := func() string {
+		var strs string
+		for i := 0; i < 4; i++ {
+			strs += httpGet("http://127.0.0.1:8999/")
+		}
+		return strs
+	}
+
+	atomic.StoreInt32(&sick, 1)
+	time.Sleep(time.Millisecond * 200)
+	if str := get(); str != "aaaa" {
+		t.Errorf("expected the unhealthy downstream to be skipped got %v", str)
+	}
+
+	atomic.StoreInt32(&sick, 0)
+	time.Sleep(time.Millisecond * 200)
+	if str := get(); !strings.Contains(str, "b") {
+		t.Errorf("expected the downstream to recover got %v", str)
+	}
+}
+
+func TestHealthCheckRewrite(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	cfg := DefaultConfig()
+	cfg.MissingRouteTimeout = time.Millisecond * 100
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP: &protocol.SocketHTTPDefinition{
+			PathPrefix: "/api/",
+			Rewrite:    &protocol.SocketHTTPRewriteDefinition{StripPrefix: true},
+		},
+		HealthCheck: &protocol.SocketHealthCheckDefinition{
+			Type:               protocol.HealthCheckHTTP,
+			Interval:           time.Millisecond * 20,
+			Timeout:            time.Second,
+			UnhealthyThreshold: 1,
+			HealthyThreshold:   1,
+		},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+	// the downstream is mounted at / so only rewritten checks succeed
+	go http.Serve(c1, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(res, req)
+			return
+		}
+		io.WriteString(res, "a")
+	}))
+
+	time.Sleep(time.Millisecond * 200)
+	if str := httpGet("http://127.0.0.1:8999/api/"); str != "a" {
+		t.Error("expected `a` got", str)
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	cfg := DefaultConfig()
+	cfg.OutlierDetection.ConsecutiveFailures = 2
+	cfg.MaxStreamsPerDownstream = 1
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	block := make(chan struct{})
+	for _, name := range []string{"good", "bad", "slow"} {
+		name := name
+		path := "/"
+		if name == "slow" {
+			path = "/slow/"
+		}
+		c, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+			Address: "127.0.0.1",
+			Port:    8999,
+			HTTP:    &protocol.SocketHTTPDefinition{PathPrefix: path},
+			Balance: &protocol.SocketBalanceDefinition{
+				Strategy: protocol.BalanceRoundRobin,
+			},
+		})
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		defer c.Close()
+		go http.Serve(c, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			switch name {
+			case "bad":
+				res.WriteHeader(http.StatusInternalServerError)
+			case "slow":
+				<-block
+			}
+			io.WriteString(res, name)
+		}))
+	}
+
+	// the failing downstream is ejected after two failures in a row
+	failures := 0
+	for i := 0; i < 8; i++ {
+		if str := httpGet("http://127.0.0.1:8999/"); str != "good" {
+			failures++
+		}
+	}
+	if failures != 2 {
+		t.Errorf("expected 2 failures before the downstream was ejected got %v", failures)
+	}
+
+	// only one stream at a time may go to the slow downstream
+	done := make(chan string)
+	go func() {
+		done <- httpGet("http://127.0.0.1:8999/slow/")
+	}()
+	time.Sleep(time.Millisecond * 100)
+	if str := httpGet("http://127.0.0.1:8999/slow/"); str != "ERROR: 503 Service Unavailable" {
+		t.Errorf("expected a 503 got %v", str)
+	}
+	close(block)
+	if str := <-done; str != "slow" {
+		t.Errorf("expected `slow` got %v", str)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	cfg := DefaultConfig()
+	cfg.OutlierDetection.FailureRate = 0.5
+	cfg.OutlierDetection.MinRequests = 4
+	cfg.OutlierDetection.Interval = time.Minute
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	for _, name := range []string{"a", "b"} {
+		name := name
+		c, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+			Address: "127.0.0.1",
+			Port:    8999,
+			HTTP:    &protocol.SocketHTTPDefinition{},
+			Balance: &protocol.SocketBalanceDefinition{
+				Strategy: protocol.BalanceRoundRobin,
+			},
+		})
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		defer c.Close()
+		// every other request to a fails so there are never two failures in
+		// a row
+		var requests int32
+		go http.Serve(c, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if name == "a" && atomic.AddInt32(&requests, 1)%2 == 1 {
+				res.WriteHeader(http.StatusInternalServerError)
+			}
+			io.WriteString(res, name)
+		}))
+	}
+
+	// a is ejected once it has failed half of its 4 requests
+	var strs []string
+	for i := 0; i < 10; i++ {
+		strs = append(strs, httpGet("http://127.0.0.1:8999/"))
+	}
+	expected := []string{
+		"ERROR: 500 Internal Server Error", "b", "a", "b",
+		"ERROR: 500 Internal Server Error", "b", "a",
+		"b", "b", "b",
+	}
+	if strings.Join(strs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v got %v", expected, strs)
+	}
+}
+
+func TestEjectLastDownstream(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	cfg := DefaultConfig()
+	cfg.OutlierDetection.ConsecutiveFailures = 2
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+	var requests int32
+	go http.Serve(c1, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 3 {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+		io.WriteString(res, "a")
+	}))
+
+	// the only downstream keeps getting traffic once it recovers
+	var strs []string
+	for i := 0; i < 4; i++ {
+		strs = append(strs, httpGet("http://127.0.0.1:8999/"))
+	}
+	expected := []string{
+		"ERROR: 500 Internal Server Error",
+		"ERROR: 500 Internal Server Error",
+		"ERROR: 500 Internal Server Error",
+		"a",
+	}
+	if strings.Join(strs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v got %v", expected, strs)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	s := New(li1, DefaultConfig())
+	defer s.Close()
+	go s.Serve()
+
+	for _, name := range []string{"good", "bad", "broken"} {
+		name := name
+		path := "/"
+		if name == "broken" {
+			path = "/broken/"
+		}
+		c, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+			Address: "127.0.0.1",
+			Port:    8999,
+			HTTP:    &protocol.SocketHTTPDefinition{PathPrefix: path},
+			Balance: &protocol.SocketBalanceDefinition{
+				Strategy: protocol.BalanceRoundRobin,
+			},
+		})
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		defer c.Close()
+		go http.Serve(c, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if name != "good" {
+				// hang up without responding
+				conn, _, err := res.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+			io.WriteString(res, name)
+		}))
+	}
+
+	// requests sent to the bad downstream are retried on the good one
+	for i := 0; i < 4; i++ {
+		if str := httpGet("http://127.0.0.1:8999/"); str != "good" {
+			t.Errorf("expected `good` got %v", str)
+			return
+		}
+	}
+
+	if str := httpGet("http://127.0.0.1:8999/broken/"); str != "ERROR: 502 Bad Gateway" {
+		t.Errorf("expected a 502 got %v", str)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	cfg := DefaultConfig()
+	cfg.ResponseHeaderTimeout = time.Millisecond * 200
+	cfg.MaxStreamsPerDownstream = 1
+	cfg.ErrorPages = []protocol.SocketHTTPErrorPage{{
+		Status:      http.StatusServiceUnavailable,
+		ContentType: "application/json",
+		Template:    `{"status":{{json .Status}},"path":{{json .Path}}}`,
+	}}
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	c1, err := client.New(li1.Addr().String()).Listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP: &protocol.SocketHTTPDefinition{
+			PathPrefix: "/slow/",
+			ErrorPages: []protocol.SocketHTTPErrorPage{{
+				Status:      http.StatusGatewayTimeout,
+				ContentType: "text/html",
+				Template:    `<h1>{{.StatusText}}: {{.Path}}</h1>`,
+			}},
+		},
+	})
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c1.Close()
+	block := make(chan struct{})
+	defer close(block)
+	go http.Serve(c1, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-block
+	}))
+
+	get := func(path string) (*http.Response, string) {
+		tr := &http.Transport{}
+		defer tr.CloseIdleConnections()
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:8999"+path, nil)
+		req.Header.Set("Accept", "application/json")
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			return &http.Response{}, err.Error()
+		}
+		defer res.Body.Close()
+		bs, _ := ioutil.ReadAll(res.Body)
+		return res, string(bs)
+	}
+
+	// the first request times out while the second finds the downstream busy
+	type result struct {
+		res  *http.Response
+		body string
+	}
+	done := make(chan result)
+	go func() {
+		res, body := get("/slow/<a>")
+		done <- result{res, body}
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	res, body := get("/slow/b")
+	if res.StatusCode != http.StatusServiceUnavailable || body != `{"status":503,"path":"/slow/b"}` ||
+		res.Header.Get("Content-Type") != "application/json" || res.Header.Get("Retry-After") != "5" {
+		t.Errorf("expected a JSON 503 got %v %v %v", res.StatusCode, res.Header, body)
+	}
+
+	r := <-done
+	if r.res.StatusCode != http.StatusGatewayTimeout || r.body != `<h1>Gateway Timeout: /slow/&lt;a&gt;</h1>` {
+		t.Errorf("expected an HTML 504 got %v %v", r.res.StatusCode, r.body)
+	}
+}
+
+func TestMissingRoute(t *testing.T) {
+	li1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	cfg := DefaultConfig()
+	cfg.MissingRouteTimeout = time.Second * 5
+	s := New(li1, cfg)
+	defer s.Close()
+	go s.Serve()
+
+	listen := func(def protocol.SocketDefinition, body string) (net.Listener, error) {
+		li, err := client.New(li1.Addr().String()).Listen(def)
+		if err != nil {
+			return nil, err
+		}
+		go http.Serve(li, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			io.WriteString(res, body)
+		}))
+		return li, nil
+	}
+	get := func(path string) (int, string) {
+		tr := &http.Transport{}
+		defer tr.CloseIdleConnections()
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:8999"+path, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer res.Body.Close()
+		bs, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(bs)
+	}
+
+	c0, err := listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{PathPrefix: "/other/"},
+	}, "other")
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c0.Close()
+
+	// a waiting request is dispatched as soon as its route is registered
+	type result struct {
+		status int
+		body   string
+	}
+	done := make(chan result)
+	go func() {
+		status, body := get("/a/")
+		done <- result{status, body}
+	}()
+	time.Sleep(time.Millisecond * 200)
+
+	start := time.Now()
+	c1, err := listen(protocol.SocketDefinition{
+		Address:             "127.0.0.1",
+		Port:                8999,
+		HTTP:                &protocol.SocketHTTPDefinition{PathPrefix: "/a/"},
+		MissingRouteTimeout: time.Millisecond * 100,
+	}, "a")
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	r := <-done
+	if r.status != http.StatusOK || r.body != "a" {
+		t.Errorf("expected a 200 from a got %v %v", r.status, r.body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the request to be dispatched on registration, took %v", elapsed)
+	}
+
+	// registering another route without a timeout doesn't reset it
+	c2, err := listen(protocol.SocketDefinition{
+		Address: "127.0.0.1",
+		Port:    8999,
+		HTTP:    &protocol.SocketHTTPDefinition{PathPrefix: "/b/"},
+	}, "b")
+	if err != nil {
+		t.Errorf("error dialing: %v", err)
+		return
+	}
+	defer c2.Close()
+
+	// once the downstream is gone its timeout still applies
+	c1.Close()
+	for i := 0; i < 30; i++ {
+		s.mu.Lock()
+		n := 0
+		for _, u := range s.upstream {
+			n += len(u.registered())
+		}
+		s.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	start = time.Now()
+	status, _ := get("/a/")
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 got %v", status)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the socket's missing route timeout, took %v", elapsed)
+	}
+}
@@ -2,10 +2,9 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"io"
-	"io/ioutil"
-	"math/rand"
 	"net"
 	"net/http"
 	"sort"
@@ -30,51 +29,82 @@ type (
 		tlsConfig      *tls.Config
 		lastUpdateTime time.Time
 		mu             sync.RWMutex
+
+		// acceptProxyProtocol means connections start with a PROXY header
+		acceptProxyProtocol bool
+
+		// balancers keep the state of each route's balancing strategy
+		balancers  map[string]balancer
+		balancerMu sync.Mutex
+		retries    retryBudget
+
+		// changed is closed (and replaced) when downstreams may have become
+		// available
+		changed chan struct{}
+		// missingRouteTimeouts are the MissingRouteTimeout overrides of each
+		// route by key ("" for TCP). They're kept after the downstreams are
+		// gone so requests wait for restarting ones as long as they asked.
+		missingRouteTimeouts map[string]routeTimeout
+	}
+	routeTimeout struct {
+		// route is nil for TCP
+		route   *httpRoute
+		timeout time.Duration
 	}
 	downstreamConnection struct {
 		id               int64
 		session          *yamux.Session
+		version          int
+		capabilities     protocol.Capabilities
 		socketDefinition protocol.SocketDefinition
+		pool             streamPool
+		// active is the number of streams currently in use
+		active int64
+		// currentWeight is the weight set by a control request, or -1
+		currentWeight int64
+		// route is set for HTTP downstreams
+		route *httpRoute
+		// unhealthy is set while health checks are failing
+		unhealthy int32
+		// failures and ejections count consecutive failures and ejections.
+		// The downstream receives no traffic until ejectedUntil (in unix
+		// nanoseconds).
+		failures, ejections int32
+		ejectedUntil        int64
+		// outcomes are counted for the failure rate
+		outcomes outcomeWindow
 	}
-	downstreamSorter []*downstreamConnection
 )
 
-func (ds downstreamSorter) Len() int {
-	return len(ds)
-}
-func (ds downstreamSorter) Less(i, j int) bool {
-	hi := ds[i].socketDefinition.HTTP
-	hj := ds[j].socketDefinition.HTTP
-
-	// http on top
-	if hi != nil && hj != nil {
-		domi := ds[i].socketDefinition.HTTP.DomainSuffix
-		domj := ds[j].socketDefinition.HTTP.DomainSuffix
+// matchRoute returns the most specific route registered for req regardless
+// of whether any of its downstreams are available
+func (u *upstreamListener) matchRoute(req *http.Request) *httpRoute {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 
-		if len(domi) > len(domj) {
-			return true
-		} else if len(domj) > len(domi) {
-			return false
+	var best *downstreamConnection
+	for _, d := range u.downstream {
+		if d.route == nil || !d.route.match(req) {
+			continue
 		}
-
-		pathi := ds[i].socketDefinition.HTTP.PathPrefix
-		pathj := ds[j].socketDefinition.HTTP.PathPrefix
-
-		if len(pathi) > len(pathj) {
-			return true
-		} else if len(pathj) > len(pathi) {
-			return false
+		if best == nil || d.route.less(best.route) ||
+			(!best.route.less(d.route) && d.id < best.id) {
+			best = d
 		}
-	} else if hi != nil && hj == nil {
-		return true
-	} else if hi == nil && hj != nil {
-		return false
 	}
-
-	return ds[i].id < ds[j].id
+	if best == nil {
+		return nil
+	}
+	return best.route
 }
-func (ds downstreamSorter) Swap(i, j int) {
-	ds[i], ds[j] = ds[j], ds[i]
+
+// removeDownstream drops a downstream whose session is broken
+func (u *upstreamListener) removeDownstream(d *downstreamConnection) {
+	d.session.Close()
+	u.mu.Lock()
+	delete(u.downstream, d.id)
+	u.mu.Unlock()
+	u.update()
 }
 
 func (u *upstreamListener) closeDownstream(id int64) {
@@ -94,185 +124,417 @@ func (u *upstreamListener) getDownstream() []*downstreamConnection {
 
 	ds := make([]*downstreamConnection, 0, len(u.downstream))
 	for _, d := range u.downstream {
-		ds = append(ds, d)
+		if d.available() {
+			ds = append(ds, d)
+		}
 	}
 
 	return ds
 }
 
-func (u *upstreamListener) findDownstreamHTTP(req *http.Request) *downstreamConnection {
+// registered returns every downstream, available or not
+func (u *upstreamListener) registered() []*downstreamConnection {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	ds := make([]*downstreamConnection, 0, len(u.downstream))
+	for _, d := range u.downstream {
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// findDownstreamHTTP returns the downstream for the most specific route
+// matching req. Downstreams registered for the same route share its traffic.
+// It returns errOverloaded if every downstream for the route is at its stream
+// limit. The returned downstream has a stream reserved which the caller has
+// to release. Downstreams in tried are skipped.
+func (u *upstreamListener) findDownstreamHTTP(req *http.Request, conn net.Conn, tried map[int64]bool) (*downstreamConnection, error) {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
 
 	ds := make([]*downstreamConnection, 0, len(u.downstream))
 
 	for _, d := range u.downstream {
-		if d.socketDefinition.HTTP != nil {
-			if strings.HasSuffix(req.Host, d.socketDefinition.HTTP.DomainSuffix) &&
-				strings.HasPrefix(req.URL.Path, d.socketDefinition.HTTP.PathPrefix) {
-				ds = append(ds, d)
-			}
+		if d.route != nil && d.route.match(req) {
+			ds = append(ds, d)
 		}
 	}
 
-	sort.Sort(downstreamSorter(ds))
+	if len(ds) == 0 {
+		return nil, nil
+	}
 
-	if len(ds) > 0 {
-		return ds[0]
+	sort.Slice(ds, func(i, j int) bool {
+		if ds[i].route.less(ds[j].route) {
+			return true
+		}
+		if ds[j].route.less(ds[i].route) {
+			return false
+		}
+		return ds[i].id < ds[j].id
+	})
+
+	// balance between the downstreams registered for the best matching route.
+	// Unavailable downstreams don't make a less specific route match.
+	key := ds[0].route.key
+	group := ds[:0]
+	for _, d := range ds {
+		if d.route.key != key {
+			break
+		}
+		if d.available() && !tried[d.id] {
+			group = append(group, d)
+		}
+	}
+	if len(group) == 0 {
+		return nil, nil
 	}
+	return u.pick(key, u.routeBalance(ds[0]), group, conn, req)
+}
 
-	return nil
+// openStream opens a stream to a downstream connection for conn. If the
+// downstream supports it the stream starts with conn's metadata. conn is nil
+// for streams the server opens itself.
+func (u *upstreamListener) openStream(d *downstreamConnection, conn net.Conn) (*yamux.Stream, error) {
+	stream, err := d.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if d.capabilities&protocol.CapabilityStreamMetadata != 0 {
+		err = protocol.WriteStreamMetadata(stream, streamMetadata(conn))
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
+func streamMetadata(conn net.Conn) protocol.StreamMetadata {
+	var md protocol.StreamMetadata
+	if conn == nil {
+		return md
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		md.RemoteIP = addr.IP.String()
+		md.RemotePort = addr.Port
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		md.LocalIP = addr.IP.String()
+		md.LocalPort = addr.Port
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		md.TLS = &protocol.StreamTLSMetadata{
+			ServerName:         state.ServerName,
+			NegotiatedProtocol: state.NegotiatedProtocol,
+		}
+		if len(state.PeerCertificates) > 0 {
+			md.TLS.ClientCertSubject = state.PeerCertificates[0].Subject.String()
+		}
+	}
+	return md
 }
 
 func (u *upstreamListener) routeHTTP(conn net.Conn) {
 	defer conn.Close()
 
-	var lastStream *yamux.Stream
-	var lastSession *yamux.Session
-	defer func() {
-		if lastStream != nil {
-			lastStream.Close()
-		}
-	}()
+	// a single buffered reader is used for the whole connection so pipelined
+	// requests aren't lost
+	connReader := bufio.NewReader(conn)
 
 	for {
-		req, err := http.ReadRequest(bufio.NewReader(conn))
+		req, err := http.ReadRequest(connReader)
 		if err != nil {
 			return
 		}
 
-		deadline := time.Now().Add(time.Second * 30)
-		for {
-			d := u.findDownstreamHTTP(req)
-			if d == nil {
-				if time.Now().After(deadline) {
-					msg := "Not Found"
-					err = (&http.Response{
-						Status:        "404 Not Found",
-						StatusCode:    404,
-						Proto:         "HTTP/1.1",
-						ProtoMajor:    1,
-						ProtoMinor:    1,
-						Body:          ioutil.NopCloser(strings.NewReader(msg)),
-						ContentLength: int64(len(msg)),
-						Request:       req,
-					}).Write(conn)
-					return
-				} else {
-					time.Sleep(time.Millisecond * 100)
-					continue
-				}
+		// HTTP/2 with prior knowledge
+		if isHTTP2Preface(req) {
+			if _, ok := conn.(*tls.Conn); ok || !u.server.config.HTTP2Cleartext {
+				return
 			}
+			u.routeHTTP2(&prefixConn{
+				Conn: conn,
+				r:    io.MultiReader(strings.NewReader(http2PrefaceRequest), connReader),
+			}, true)
+			return
+		}
 
-			if d.session != lastSession && lastStream != nil {
-				lastStream.Close()
+		var d *downstreamConnection
+		var bs *backendStream
+		var reused bool
+		deadline := time.Now().Add(u.httpMissingRouteTimeout(req))
+		for {
+			found := u.await(req.Context(), deadline, func() bool {
+				d, err = u.findDownstreamHTTP(req, conn, nil)
+				return d != nil || err != nil
+			})
+			if !found || err == errOverloaded {
+				u.writeError(conn, req, http.StatusServiceUnavailable)
+				return
 			}
-			lastSession = d.session
 
-			lastStream, err = lastSession.OpenStream()
+			bs, reused, err = u.getStream(d)
 			if err != nil {
-				lastSession = nil
-				lastStream = nil
-
-				d.session.Close()
-				u.mu.Lock()
-				delete(u.downstream, d.id)
-				u.mu.Unlock()
-				u.update()
+				d.release()
+				u.removeDownstream(d)
 				continue
 			}
 			break
 		}
 
-		err = req.Write(lastStream)
-		if err != nil {
+		ok := u.forwardHTTP(conn, connReader, d, bs, reused, req)
+		if !ok {
 			return
 		}
-		res, err := http.ReadResponse(bufio.NewReader(lastStream), req)
-		if err != nil {
-			return
+	}
+}
+
+// forwardHTTP sends a request to a downstream and writes the response to
+// conn. Idempotent requests which fail are retried on other downstreams. The
+// downstream's reservation is released. It returns false if the connection
+// can't be used for more requests.
+func (u *upstreamListener) forwardHTTP(conn net.Conn, connReader io.Reader, d *downstreamConnection, bs *backendStream, reused bool, req *http.Request) bool {
+	defer func() {
+		if d != nil {
+			d.release()
+		}
+	}()
+
+	u.server.config.Forwarded.setForwardedHeaders(req, conn)
+	u.retries.deposit(u.server.config.Retries.BudgetRatio)
+	body, retryable := u.replayableBody(req)
+
+	var tried map[int64]bool
+	var out *http.Request
+	var res *http.Response
+	var err error
+	for {
+		bs, out, res, err = u.send(d, bs, reused, req, body, conn, conn)
+		if err == nil {
+			break
+		}
+		if !retryable {
+			u.writeError(conn, req, gatewayStatus(err))
+			return false
 		}
-		err = res.Write(conn)
+		if tried == nil {
+			tried = map[int64]bool{}
+		}
+		d, bs, reused = u.retry(d, req, conn, tried)
+		if d == nil {
+			u.writeError(conn, req, gatewayStatus(err))
+			return false
+		}
+	}
+
+	if rw := d.route.rewrite; rw != nil {
+		rw.response(res.Header)
+	}
+
+	// the body is copied as it's read so streamed responses (server-sent
+	// events, long polls, ...) aren't held back
+	err = res.Write(conn)
+	if err != nil {
+		bs.Close()
+		return false
+	}
+
+	// after a successful upgrade (WebSocket, h2c, ...) the connection no
+	// longer speaks HTTP/1.1 so just pass the bytes along
+	if res.StatusCode == http.StatusSwitchingProtocols && isUpgrade(out.Header) {
+		splice(conn, bs.stream, connReader, bs.reader)
+		return false
+	}
+
+	if res.Close {
+		bs.Close()
+	} else {
+		u.putStream(d, bs)
+	}
+	return !req.Close && !res.Close
+}
+
+// roundTrip sends a request over a stream and reads the final response,
+// passing any informational responses along to info if it isn't nil
+func (u *upstreamListener) roundTrip(bs *backendStream, req *http.Request, info io.Writer) (*http.Response, error) {
+	err := req.Write(bs.stream)
+	if err != nil {
+		return nil, err
+	}
+	if t := u.server.config.ResponseHeaderTimeout; t > 0 {
+		bs.stream.SetReadDeadline(time.Now().Add(t))
+		defer bs.stream.SetReadDeadline(time.Time{})
+	}
+	for {
+		res, err := http.ReadResponse(bs.reader, req)
 		if err != nil {
-			return
+			return nil, err
+		}
+		if res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+			if info != nil {
+				err = res.Write(info)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		return res, nil
+	}
+}
+
+// isUpgrade returns true if the headers request a protocol upgrade
+func isUpgrade(h http.Header) bool {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+// splice copies data between conn and stream in both directions until either
+// side is done. Data is read through connReader and streamReader so anything
+// they've already buffered is passed along.
+func splice(conn net.Conn, stream *yamux.Stream, connReader, streamReader io.Reader) {
+	signal := make(chan struct{}, 2)
+	go func() {
+		io.Copy(stream, connReader)
+		signal <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, streamReader)
+		signal <- struct{}{}
+	}()
+	<-signal
+	conn.Close()
+	stream.Close()
 }
 
 func (u *upstreamListener) routeTCP(conn net.Conn) {
+	var d *downstreamConnection
 	var stream *yamux.Stream
 	var err error
 
-	deadline := time.Now().Add(30 * time.Second)
+	// downstreams which failed are skipped for the rest of the connection
+	var tried map[int64]bool
+	deadline := time.Now().Add(u.listenerTimeout())
 	for {
-		ds := u.getDownstream()
-		if len(ds) == 0 {
-			if time.Now().After(deadline) {
-				conn.Close()
-				return
-			} else {
-				time.Sleep(time.Millisecond * 100)
-				continue
+		var ds []*downstreamConnection
+		found := u.await(context.Background(), deadline, func() bool {
+			ds = ds[:0]
+			for _, d := range u.getDownstream() {
+				if !tried[d.id] {
+					ds = append(ds, d)
+				}
+			}
+			return len(ds) > 0
+		})
+		if !found {
+			conn.Close()
+			return
+		}
+		sort.Slice(ds, func(i, j int) bool {
+			return ds[i].id < ds[j].id
+		})
+		u.mu.RLock()
+		def := u.routeBalance(ds[0])
+		u.mu.RUnlock()
+		d, err = u.pick("", def, ds, conn, nil)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		stream, err = u.openStream(d, conn)
+		if err == nil {
+			if pp := d.socketDefinition.ProxyProtocol; pp != nil && pp.Send != 0 {
+				err = writeProxyHeader(stream, pp.Send, conn.RemoteAddr(), conn.LocalAddr())
+				if err != nil {
+					stream.Close()
+				}
 			}
 		}
-		d := ds[rand.Intn(len(ds))]
-		stream, err = d.session.OpenStream()
 		if err != nil {
 			u.server.config.Logger.Printf("failed to open stream: %v\n", err)
-			d.session.Close()
-			u.mu.Lock()
-			delete(u.downstream, d.id)
-			u.mu.Unlock()
-			u.update()
+			d.release()
+			u.observe(d, false)
+			if d.session.IsClosed() {
+				u.removeDownstream(d)
+			}
+			if tried == nil {
+				tried = map[int64]bool{}
+			}
+			tried[d.id] = true
 			continue
 		}
+		u.observe(d, true)
 		break
 	}
 
 	go func() {
-		signal := make(chan struct{}, 2)
-		go func() {
-			io.Copy(stream, conn)
-			signal <- struct{}{}
-		}()
-		go func() {
-			io.Copy(conn, stream)
-			signal <- struct{}{}
-		}()
-		<-signal
-		conn.Close()
-		stream.Close()
+		defer d.release()
+		splice(conn, stream, conn, stream)
 	}()
 }
 
 func (u *upstreamListener) route(conn net.Conn) {
 	u.mu.RLock()
-	if u.tlsConfig != nil {
-		conn = tls.Server(conn, u.tlsConfig)
-	}
+	tlsConfig := u.tlsConfig
 	u.mu.RUnlock()
 
-	deadline := time.Now().Add(time.Second * 30)
-	for {
-		ds := u.getDownstream()
+	if u.acceptProxyProtocol {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		src, dst, err := readProxyHeader(conn)
+		if err != nil {
+			u.server.config.Logger.Printf("failed to read proxy protocol header: %v\n", err)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		if src != nil {
+			conn = &proxyConn{Conn: conn, remoteAddr: src, localAddr: dst}
+		}
+	}
 
-		if len(ds) == 0 {
-			if time.Now().After(deadline) {
-				conn.Close()
-				return
-			} else {
-				time.Sleep(time.Millisecond * 100)
-				continue
-			}
+	// complete the TLS handshake up front so its details can be passed along
+	// to the downstream
+	if tlsConfig != nil {
+		tlsConn := tls.Server(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		err := tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return
 		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
 
-		if ds[0].socketDefinition.HTTP != nil {
-			go u.routeHTTP(conn)
+	// HTTP connections wait for a route per request so only wait for the
+	// protocol to be known here
+	var ds []*downstreamConnection
+	found := u.await(context.Background(), time.Now().Add(u.listenerTimeout()), func() bool {
+		ds = u.registered()
+		return len(ds) > 0
+	})
+	if !found {
+		conn.Close()
+		return
+	}
+
+	if ds[0].socketDefinition.HTTP != nil {
+		if tlsConn, ok := conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			go u.routeHTTP2(conn, false)
 		} else {
-			go u.routeTCP(conn)
+			go u.routeHTTP(conn)
 		}
-
-		break
+	} else {
+		go u.routeTCP(conn)
 	}
 }
 
@@ -280,21 +542,55 @@ func (u *upstreamListener) update() {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
+	// nothing is served once the listener is closed
+	if u.listener == nil {
+		return
+	}
+
 	// rebuild the TLS config
 	certs := make([]tls.Certificate, 0)
+	// clientCertNames are the names of certificates which request client
+	// certificates
+	clientCertNames := map[string]bool{}
+	isHTTP := false
 	for _, d := range u.downstream {
+		if d.socketDefinition.HTTP != nil {
+			isHTTP = true
+		}
 		if d.socketDefinition.TLS != nil {
 			cert, err := tls.X509KeyPair([]byte(d.socketDefinition.TLS.Cert), []byte(d.socketDefinition.TLS.Key))
 			if err == nil {
 				certs = append(certs, cert)
+				if d.socketDefinition.TLS.RequestClientCert {
+					names, _ := certificateNames(d.socketDefinition.TLS)
+					for _, name := range names {
+						clientCertNames[strings.ToLower(name)] = true
+					}
+				}
 			} else {
 				u.server.config.Logger.Printf("failed to load tls cert: %v\n", err)
 			}
 		}
 	}
 	if len(certs) > 0 {
-		u.tlsConfig = &tls.Config{Certificates: certs}
+		u.tlsConfig = &tls.Config{
+			Certificates: certs,
+		}
+		if isHTTP {
+			u.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
 		u.tlsConfig.BuildNameToCertificate()
+		if len(clientCertNames) > 0 {
+			// client certificates are optional but passed along if sent
+			withClientCert := u.tlsConfig.Clone()
+			withClientCert.ClientAuth = tls.RequestClientCert
+			u.tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if matchesName(clientCertNames, hello.ServerName) {
+					return withClientCert, nil
+				}
+				return nil, nil
+			}
+		}
 	} else {
 		u.tlsConfig = nil
 	}
@@ -310,6 +606,23 @@ func (u *upstreamListener) update() {
 	}
 
 	u.lastUpdateTime = time.Now()
+	u.notifyLocked()
+}
+
+// matchesName returns true if serverName is one of names or matches one of
+// their wildcards
+func matchesName(names map[string]bool, serverName string) bool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" {
+		return false
+	}
+	if names[serverName] {
+		return true
+	}
+	if i := strings.Index(serverName, "."); i > 0 {
+		return names["*"+serverName[i:]]
+	}
+	return false
 }
 
 func (u *upstreamListener) close() {
@@ -321,4 +634,9 @@ func (u *upstreamListener) close() {
 		u.listener.Close()
 		u.listener = nil
 	}
+
+	// let the downstream connections know they need to register again
+	for _, d := range u.downstream {
+		d.session.Close()
+	}
 }
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// changes returns a channel which is closed the next time downstreams may
+// have become available
+func (u *upstreamListener) changes() <-chan struct{} {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.changed
+}
+
+// notify wakes up everything waiting for a downstream
+func (u *upstreamListener) notify() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.notifyLocked()
+}
+
+func (u *upstreamListener) notifyLocked() {
+	close(u.changed)
+	u.changed = make(chan struct{})
+}
+
+// await calls ready until it returns true, waiting for downstreams to change
+// in between. It returns false if the deadline passes or ctx is done first.
+func (u *upstreamListener) await(ctx context.Context, deadline time.Time, ready func() bool) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		// get the channel before checking so a change in between isn't missed
+		changed := u.changes()
+		if ready() {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// setMissingRouteTimeout overrides how long connections for route (nil for
+// TCP) wait for a downstream. u.mu must be held.
+func (u *upstreamListener) setMissingRouteTimeout(route *httpRoute, timeout time.Duration) {
+	var key string
+	if route != nil {
+		key = route.key
+	}
+	u.missingRouteTimeouts[key] = routeTimeout{route: route, timeout: timeout}
+}
+
+// listenerTimeout returns how long TCP connections wait for a downstream
+func (u *upstreamListener) listenerTimeout() time.Duration {
+	u.mu.RLock()
+	rt, ok := u.missingRouteTimeouts[""]
+	u.mu.RUnlock()
+	if ok {
+		return rt.timeout
+	}
+	return u.server.config.MissingRouteTimeout
+}
+
+// httpMissingRouteTimeout returns how long req waits for a downstream. The
+// override of the most specific route it matches is used if there is one,
+// even if the route's downstreams are gone.
+func (u *upstreamListener) httpMissingRouteTimeout(req *http.Request) time.Duration {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	var best *httpRoute
+	consider := func(r *httpRoute) {
+		if r != nil && r.match(req) && (best == nil || r.less(best)) {
+			best = r
+		}
+	}
+	for _, d := range u.downstream {
+		consider(d.route)
+	}
+	for _, rt := range u.missingRouteTimeouts {
+		consider(rt.route)
+	}
+	if best != nil {
+		if rt, ok := u.missingRouteTimeouts[best.key]; ok {
+			return rt.timeout
+		}
+	}
+	return u.server.config.MissingRouteTimeout
+}